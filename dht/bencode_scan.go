@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// maxBencodeDepth bounds list and dictionary nesting when scanning
+const maxBencodeDepth = 64
+
+// bencodeValueEnd returns the offset just past the bencoded value starting
+// at data[start]. bencode.Decode reads through a bufio.Reader and so cannot
+// report how much input a value used; this is needed where raw bytes follow
+// a bencoded value, as in ut_metadata data messages.
+func bencodeValueEnd(data []byte, start int) (int, error) {
+	return scanBencode(data, start, 0)
+}
+
+func scanBencode(data []byte, i, depth int) (int, error) {
+	if i >= len(data) {
+		return 0, fmt.Errorf("bencode: unexpected end of data")
+	}
+	switch c := data[i]; {
+	case c == 'i':
+		end := indexByteFrom(data, 'e', i+1)
+		if end == -1 {
+			return 0, fmt.Errorf("bencode: unterminated integer at %d", i)
+		}
+		if _, err := strconv.ParseInt(string(data[i+1:end]), 10, 64); err != nil {
+			return 0, fmt.Errorf("bencode: invalid integer at %d", i)
+		}
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		if depth >= maxBencodeDepth {
+			return 0, fmt.Errorf("bencode: nesting too deep at %d", i)
+		}
+		i++
+		for {
+			if i >= len(data) {
+				return 0, fmt.Errorf("bencode: unterminated %c at %d", c, i)
+			}
+			if data[i] == 'e' {
+				return i + 1, nil
+			}
+			if c == 'd' && (data[i] < '0' || data[i] > '9') {
+				return 0, fmt.Errorf("bencode: dictionary key is not a string at %d", i)
+			}
+			end, err := scanBencode(data, i, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+			if c == 'd' {
+				if i, err = scanBencode(data, i, depth+1); err != nil {
+					return 0, err
+				}
+			}
+		}
+	case c >= '0' && c <= '9':
+		colon := indexByteFrom(data, ':', i)
+		if colon == -1 {
+			return 0, fmt.Errorf("bencode: unterminated string length at %d", i)
+		}
+		length, err := strconv.Atoi(string(data[i:colon]))
+		if err != nil || length < 0 || length > len(data)-colon-1 {
+			return 0, fmt.Errorf("bencode: invalid string length at %d", i)
+		}
+		return colon + 1 + length, nil
+	default:
+		return 0, fmt.Errorf("bencode: unexpected byte %q at %d", c, i)
+	}
+}
+
+func indexByteFrom(data []byte, c byte, from int) int {
+	if i := bytes.IndexByte(data[from:], c); i != -1 {
+		return from + i
+	}
+	return -1
+}
+
+// bencodeDictValue returns the raw bencoded value stored under key in the
+// dictionary data, or nil if there is none. It is used for values of any
+// type, such as a BEP 44 "v", which bencode.Unmarshal cannot decode into a
+// struct field.
+func bencodeDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("bencode: not a dictionary")
+	}
+	for i := 1; i < len(data) && data[i] != 'e'; {
+		if data[i] < '0' || data[i] > '9' {
+			return nil, fmt.Errorf("bencode: dictionary key is not a string at %d", i)
+		}
+		keyEnd, err := scanBencode(data, i, 1)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := scanBencode(data, keyEnd, 1)
+		if err != nil {
+			return nil, err
+		}
+		colon := indexByteFrom(data, ':', i)
+		if string(data[colon+1:keyEnd]) == key {
+			return data[keyEnd:valueEnd], nil
+		}
+		i = valueEnd
+	}
+	return nil, nil
+}
@@ -0,0 +1,80 @@
+package dht
+
+import "testing"
+
+func TestBencodeValueEnd(t *testing.T) {
+	tests := []struct {
+		data string
+		end  int // -1 for an error
+	}{
+		{"i42e", 4},
+		{"i-7etrailing", 4},
+		{"4:spamraw piece data", 6},
+		{"0:", 2},
+		{"le", 2},
+		{"d1:ad1:bli1ei2eeee", 18},
+		{"d8:msg_typei1e5:piecei0eexxxx", 25},
+		{"", -1},
+		{"i42", -1},
+		{"iabce", -1},
+		{"5:ab", -1},
+		{"-1:a", -1},
+		{"d1:a", -1},
+		{"l4:spam", -1},
+		{"di1ei2ee", -1},
+		{"x", -1},
+	}
+	for _, tt := range tests {
+		end, err := bencodeValueEnd([]byte(tt.data), 0)
+		if tt.end == -1 {
+			if err == nil {
+				t.Errorf("bencodeValueEnd(%q) = %d, want an error", tt.data, end)
+			}
+			continue
+		}
+		if err != nil || end != tt.end {
+			t.Errorf("bencodeValueEnd(%q) = %d, %v, want %d", tt.data, end, err, tt.end)
+		}
+	}
+}
+
+func TestBencodeValueEndDepth(t *testing.T) {
+	deep := make([]byte, 0, 2*(maxBencodeDepth+1))
+	for i := 0; i <= maxBencodeDepth; i++ {
+		deep = append(deep, 'l')
+	}
+	for i := 0; i <= maxBencodeDepth; i++ {
+		deep = append(deep, 'e')
+	}
+	if _, err := bencodeValueEnd(deep, 0); err == nil {
+		t.Errorf("bencodeValueEnd accepted nesting deeper than %d", maxBencodeDepth)
+	}
+	if end, err := bencodeValueEnd(deep[1:len(deep)-1], 0); err != nil || end != len(deep)-2 {
+		t.Errorf("bencodeValueEnd at the depth limit = %d, %v", end, err)
+	}
+}
+
+func TestBencodeDictValue(t *testing.T) {
+	data := []byte("d1:ad1:vi1ee1:v4:spam1:wli1eee")
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"a", "d1:vi1ee"},
+		{"v", "4:spam"},
+		{"w", "li1ee"},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		value, err := bencodeDictValue(data, tt.key)
+		if err != nil || string(value) != tt.want {
+			t.Errorf("bencodeDictValue(%q) = %q, %v, want %q", tt.key, value, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"li1ee", "di1e1:ve", "d1:v4:sp"} {
+		if _, err := bencodeDictValue([]byte(bad), "v"); err == nil {
+			t.Errorf("bencodeDictValue(%q) did not fail", bad)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Blocklist configuration
+const (
+	blocklistEnvFiles       = "DHT_BLOCKLIST"        // Comma-separated blocklist files added to the configured ones
+	blocklistEnvBogons      = "DHT_BLOCKLIST_BOGONS" // "0" or "false" lets reserved and private ranges through
+	blocklistReloadInterval = 10 * time.Minute
+	autoBanDuration         = 24 * time.Hour
+	maxAutoBans             = 100000
+	datMaxBlockedLevel      = 127 // DAT entries with a higher access level are allowed
+)
+
+// Reserved, private and documentation ranges that no public DHT node or
+// peer can have
+var bogonRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/3", // Multicast and reserved
+	"::/128",
+	"::1/128",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// BlocklistConfig describes the IPs the crawler never talks to
+type BlocklistConfig struct {
+	// Files are blocklists with one entry per line in any of these formats:
+	//   CIDR or single IP:  1.2.3.0/24, 2001:db8::1
+	//   P2P plaintext:      Some description:1.2.3.0-1.2.3.255
+	//   DAT (eMule):        001.002.003.000 - 001.002.003.255 , 000 , Some description
+	// Blank lines and lines starting with # or // are ignored.
+	Files []string
+	// BlockBogons blocks the reserved and private ranges. It is ignored
+	// when a bootstrap router is a literal address in one of them, since the
+	// crawler is then pointed at a private test DHT.
+	BlockBogons bool
+	// AutoBan bans, for autoBanDuration, the IPs of nodes that send
+	// malformed or spoofed responses
+	AutoBan bool
+}
+
+// Blocklist is the configuration used by the crawler. DHT_BLOCKLIST adds
+// list files and DHT_BLOCKLIST_BOGONS=0 turns off BlockBogons. Files are
+// re-read every blocklistReloadInterval.
+var Blocklist = BlocklistConfig{
+	BlockBogons: true,
+	AutoBan:     true,
+}
+
+var errBlocked = errors.New("address is blocklisted")
+
+// withEnv adds the DHT_BLOCKLIST files to c and lets DHT_BLOCKLIST_BOGONS
+// turn off bogon blocking
+func (c BlocklistConfig) withEnv() BlocklistConfig {
+	c.Files = append(append([]string{}, c.Files...), splitList(os.Getenv(blocklistEnvFiles))...)
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(blocklistEnvBogons))) {
+	case "0", "false", "no":
+		c.BlockBogons = false
+	}
+	return c
+}
+
+// ipRange is an inclusive range of IPs, IPv4 in its IPv4-mapped form
+type ipRange struct {
+	first, last [16]byte
+}
+
+// ipRanges is a sorted list of non-overlapping ranges
+type ipRanges []ipRange
+
+// ipKey returns the 16-byte form of ip
+func ipKey(ip net.IP) ([16]byte, bool) {
+	var key [16]byte
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return key, false
+	}
+	copy(key[:], ip16)
+	return key, true
+}
+
+// normalize sorts the ranges and merges the overlapping and adjacent ones
+func (r ipRanges) normalize() ipRanges {
+	sort.Slice(r, func(i, j int) bool { return bytes.Compare(r[i].first[:], r[j].first[:]) < 0 })
+	var merged ipRanges
+	for _, rng := range r {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			next := prev.last
+			if incrementKey(&next) && bytes.Compare(rng.first[:], next[:]) > 0 {
+				merged = append(merged, rng)
+				continue
+			}
+			if bytes.Compare(rng.last[:], prev.last[:]) > 0 {
+				prev.last = rng.last
+			}
+			continue
+		}
+		merged = append(merged, rng)
+	}
+	return merged
+}
+
+// incrementKey adds one to key, reporting false if it overflowed
+func incrementKey(key *[16]byte) bool {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ipRanges) contains(key [16]byte) bool {
+	i := sort.Search(len(r), func(i int) bool { return bytes.Compare(r[i].last[:], key[:]) >= 0 })
+	return i < len(r) && bytes.Compare(r[i].first[:], key[:]) <= 0
+}
+
+// parseCIDRRange returns the range of a CIDR block
+func parseCIDRRange(cidr string) (ipRange, bool) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ipRange{}, false
+	}
+	ones, bits := network.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	first, _ := ipKey(network.IP)
+	last := first
+	for i := ones; i < 8*net.IPv6len; i++ {
+		last[i/8] |= 0x80 >> (i % 8)
+	}
+	return ipRange{first: first, last: last}, true
+}
+
+// parseRangeIP parses an IP in a P2P or DAT list, where IPv4 octets may be
+// zero-padded
+func parseRangeIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != net.IPv4len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, octet := range octets {
+		n, err := strconv.Atoi(octet)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16()
+}
+
+// parseIPRange parses "first-last"
+func parseIPRange(s string) (ipRange, bool) {
+	dash := strings.Index(s, "-")
+	if dash < 0 {
+		return ipRange{}, false
+	}
+	first, okFirst := ipKey(parseRangeIP(s[:dash]))
+	last, okLast := ipKey(parseRangeIP(s[dash+1:]))
+	if !okFirst || !okLast || bytes.Compare(first[:], last[:]) > 0 {
+		return ipRange{}, false
+	}
+	return ipRange{first: first, last: last}, true
+}
+
+// parseBlocklistLine parses one line of a CIDR, P2P or DAT blocklist
+func parseBlocklistLine(line string) (ipRange, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+		return ipRange{}, false
+	}
+
+	// DAT: "first - last , level , description"
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if rng, ok := parseIPRange(fields[0]); ok {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			return rng, err != nil || level <= datMaxBlockedLevel
+		}
+	}
+
+	// P2P: "description:first-last". Both the description and IPv6
+	// addresses may contain colons, so the range is the longest tail after
+	// a colon that parses.
+	if strings.Contains(line, "-") {
+		if rng, ok := parseIPRange(line); ok {
+			return rng, true
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] != ':' {
+				continue
+			}
+			if rng, ok := parseIPRange(line[i+1:]); ok {
+				return rng, true
+			}
+		}
+		return ipRange{}, false
+	}
+
+	// CIDR or a single IP
+	if strings.Contains(line, "/") {
+		return parseCIDRRange(line)
+	}
+	key, ok := ipKey(net.ParseIP(line))
+	return ipRange{first: key, last: key}, ok
+}
+
+// readBlocklistFile reads the ranges of a blocklist file, skipping lines
+// that cannot be parsed
+func readBlocklistFile(path string) (ipRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blocklist: %v", err)
+	}
+	defer f.Close()
+
+	var ranges ipRanges
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rng, ok := parseBlocklistLine(scanner.Text()); ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %v", err)
+	}
+	return ranges, nil
+}
+
+// ranges returns the ranges of a configuration. Unreadable files are
+// skipped so that one bad list does not stop the crawl.
+func (c BlocklistConfig) ranges() ipRanges {
+	var ranges ipRanges
+	if c.BlockBogons {
+		var bogons ipRanges
+		for _, cidr := range bogonRanges {
+			if rng, ok := parseCIDRRange(cidr); ok {
+				bogons = append(bogons, rng)
+			}
+		}
+		bogons = bogons.normalize()
+		if !privateBootstrap(bogons) {
+			ranges = append(ranges, bogons...)
+		}
+	}
+	for _, path := range c.Files {
+		fileRanges, err := readBlocklistFile(path)
+		if err != nil {
+			log.Printf("Skipping blocklist %s: %v", path, err)
+			continue
+		}
+		ranges = append(ranges, fileRanges...)
+	}
+	return ranges.normalize()
+}
+
+// privateBootstrap reports whether a bootstrap router is a literal address
+// in bogons. Hostnames are not resolved, as the ranges may be loaded while
+// a packet is being handled.
+func privateBootstrap(bogons ipRanges) bool {
+	for _, router := range Bootstrap.withEnv().Routers {
+		key, ok := ipKey(net.ParseIP(peerHost(router)))
+		if ok && bogons.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipBlocklist holds the loaded ranges and the automatic bans
+type ipBlocklist struct {
+	mu        sync.RWMutex
+	ranges    ipRanges
+	loaded    time.Time
+	reloading int32
+	banned    map[[16]byte]time.Time // Ban expiry per IP
+	blocked   uint64                 // Packets, queries and peers refused
+	autoBans  uint64
+}
+
+var blocklist = &ipBlocklist{banned: make(map[[16]byte]time.Time)}
+
+// current returns the loaded ranges. The first call loads them; later
+// calls reload them in the background once they are stale, so packet
+// handling never waits for the files to be read.
+func (b *ipBlocklist) current() ipRanges {
+	b.mu.RLock()
+	ranges, loaded := b.ranges, b.loaded
+	b.mu.RUnlock()
+	if loaded.IsZero() {
+		b.reload()
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return b.ranges
+	}
+	if time.Since(loaded) > blocklistReloadInterval && atomic.CompareAndSwapInt32(&b.reloading, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&b.reloading, 0)
+			b.reload()
+		}()
+	}
+	return ranges
+}
+
+func (b *ipBlocklist) reload() {
+	ranges := Blocklist.withEnv().ranges()
+	b.mu.Lock()
+	b.ranges = ranges
+	b.loaded = time.Now()
+	b.mu.Unlock()
+}
+
+// contains reports whether ip is in a blocked range or banned
+func (b *ipBlocklist) contains(ip net.IP) bool {
+	key, ok := ipKey(ip)
+	if !ok {
+		return false
+	}
+	blocked := b.current().contains(key)
+	if !blocked {
+		b.mu.RLock()
+		expiry, ok := b.banned[key]
+		b.mu.RUnlock()
+		blocked = ok && time.Now().Before(expiry)
+	}
+	if blocked {
+		atomic.AddUint64(&b.blocked, 1)
+	}
+	return blocked
+}
+
+// ban blocks ip for autoBanDuration, if automatic banning is enabled
+func (b *ipBlocklist) ban(ip net.IP) {
+	key, ok := ipKey(ip)
+	if !ok || !Blocklist.AutoBan {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.banned) >= maxAutoBans {
+		for k, expiry := range b.banned {
+			if now.After(expiry) {
+				delete(b.banned, k)
+			}
+		}
+		if len(b.banned) >= maxAutoBans {
+			return
+		}
+	}
+	if _, ok := b.banned[key]; !ok {
+		atomic.AddUint64(&b.autoBans, 1)
+	}
+	b.banned[key] = now.Add(autoBanDuration)
+}
+
+// blockedIP reports whether the crawler must not talk to ip
+func blockedIP(ip net.IP) bool {
+	return blocklist.contains(ip)
+}
+
+// blockedAddr reports whether the crawler must not talk to address
+// (ip:port). Addresses with a hostname are not blocked here; the
+// transport checks them once resolved.
+func blockedAddr(address string) bool {
+	ip := net.ParseIP(peerHost(address))
+	return ip != nil && blockedIP(ip)
+}
+
+// autoBanAddr bans the IP of a node that sent a malformed or spoofed
+// response
+func autoBanAddr(address string) {
+	if ip := net.ParseIP(peerHost(address)); ip != nil {
+		blocklist.ban(ip)
+	}
+}
+
+// BlocklistStats summarises the blocklist
+type BlocklistStats struct {
+	Ranges   int    // Blocked ranges after merging
+	Banned   int    // IPs currently banned automatically
+	AutoBans uint64 // IPs banned automatically since start
+	Blocked  uint64 // Packets, queries and peers refused
+}
+
+// GetBlocklistStats returns a snapshot of the blocklist statistics
+func GetBlocklistStats() BlocklistStats {
+	ranges := blocklist.current()
+	now := time.Now()
+	blocklist.mu.RLock()
+	defer blocklist.mu.RUnlock()
+	stats := BlocklistStats{
+		Ranges:   len(ranges),
+		AutoBans: atomic.LoadUint64(&blocklist.autoBans),
+		Blocked:  atomic.LoadUint64(&blocklist.blocked),
+	}
+	for _, expiry := range blocklist.banned {
+		if now.Before(expiry) {
+			stats.Banned++
+		}
+	}
+	return stats
+}
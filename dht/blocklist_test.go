@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBlocklistLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		first, last string // Empty if the line is skipped
+	}{
+		{"1.2.3.0/24", "1.2.3.0", "1.2.3.255"},
+		{"2001:db8::/126", "2001:db8::", "2001:db8::3"},
+		{"8.8.8.8", "8.8.8.8", "8.8.8.8"},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::1"},
+		{"Some org:5.6.7.0-5.6.7.255", "5.6.7.0", "5.6.7.255"},
+		{"Bad: corp-x:5.6.7.0-5.6.7.255", "5.6.7.0", "5.6.7.255"},
+		{"Some org:2001:db8::1-2001:db8::ff", "2001:db8::1", "2001:db8::ff"},
+		{"1.1.1.0-1.1.1.9", "1.1.1.0", "1.1.1.9"},
+		{"009.010.011.000 - 009.010.011.255 , 000 , Some, desc", "9.10.11.0", "9.10.11.255"},
+		{"009.010.012.000 - 009.010.012.255 , 127 , blocked", "9.10.12.0", "9.10.12.255"},
+		{"009.010.013.000 - 009.010.013.255 , 200 , allowed", "", ""},
+		{"5.6.7.9-5.6.7.0", "", ""},
+		{"1.2.3.256", "", ""},
+		{"# comment", "", ""},
+		{"// comment", "", ""},
+		{"", "", ""},
+		{"garbage", "", ""},
+	}
+	for _, tt := range tests {
+		rng, ok := parseBlocklistLine(tt.line)
+		if tt.first == "" {
+			if ok {
+				t.Errorf("parseBlocklistLine(%q) = %v-%v, want it skipped", tt.line, net.IP(rng.first[:]), net.IP(rng.last[:]))
+			}
+			continue
+		}
+		first, _ := ipKey(net.ParseIP(tt.first))
+		last, _ := ipKey(net.ParseIP(tt.last))
+		if !ok || rng.first != first || rng.last != last {
+			t.Errorf("parseBlocklistLine(%q) = %v-%v, %v, want %s-%s", tt.line, net.IP(rng.first[:]), net.IP(rng.last[:]), ok, tt.first, tt.last)
+		}
+	}
+}
+
+func TestIPRangesContains(t *testing.T) {
+	var ranges ipRanges
+	for _, line := range []string{"10.0.0.5-10.0.0.9", "10.0.0.0/29", "10.0.0.10", "192.168.0.0/16", "2001:db8::/32"} {
+		rng, ok := parseBlocklistLine(line)
+		if !ok {
+			t.Fatalf("parseBlocklistLine(%q) failed", line)
+		}
+		ranges = append(ranges, rng)
+	}
+	ranges = ranges.normalize()
+	if len(ranges) != 3 {
+		t.Errorf("normalize() left %d ranges, want overlapping and adjacent ones merged into 3", len(ranges))
+	}
+
+	tests := map[string]bool{
+		"10.0.0.0":      true,
+		"10.0.0.10":     true,
+		"10.0.0.11":     false,
+		"192.168.255.1": true,
+		"192.169.0.0":   false,
+		"2001:db8::1":   true,
+		"2001:db9::":    false,
+		"::ffff:a00:1":  true, // 10.0.0.1 in its IPv4-mapped form
+	}
+	for ip, want := range tests {
+		key, _ := ipKey(net.ParseIP(ip))
+		if got := ranges.contains(key); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestBlocklistConfigRanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.p2p")
+	if err := os.WriteFile(path, []byte("# test list\nx:8.8.8.0-8.8.8.255\n8.8.9.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	savedBootstrap := Bootstrap
+	defer func() { Bootstrap = savedBootstrap }()
+	t.Setenv(bootstrapEnvRouters, "")
+	t.Setenv(blocklistEnvBogons, "")
+	Bootstrap.Routers = []string{"router.example.com:6881"}
+
+	contains := func(ranges ipRanges, ip string) bool {
+		key, _ := ipKey(net.ParseIP(ip))
+		return ranges.contains(key)
+	}
+
+	ranges := BlocklistConfig{Files: []string{path, "/nonexistent"}, BlockBogons: true}.withEnv().ranges()
+	for ip, want := range map[string]bool{"8.8.8.8": true, "8.8.9.9": true, "8.8.10.1": false, "127.0.0.1": true, "fe80::1": true} {
+		if got := contains(ranges, ip); got != want {
+			t.Errorf("%s blocked = %v, want %v", ip, got, want)
+		}
+	}
+
+	// A private bootstrap router means a private DHT
+	Bootstrap.Routers = []string{"10.0.0.5:6881"}
+	if contains(BlocklistConfig{BlockBogons: true}.withEnv().ranges(), "10.0.0.6") {
+		t.Error("bogons blocked with a private bootstrap router")
+	}
+
+	Bootstrap.Routers = []string{"router.example.com:6881"}
+	t.Setenv(blocklistEnvBogons, "0")
+	if contains(BlocklistConfig{BlockBogons: true}.withEnv().ranges(), "10.0.0.6") {
+		t.Errorf("bogons blocked with %s=0", blocklistEnvBogons)
+	}
+}
@@ -1,13 +1,10 @@
 package dht
 
 import (
-	"bytes"
 	"fmt"
 	"log"
-	"strconv"
 
 	"github.com/boltdb/bolt"
-	"github.com/jackpal/bencode-go"
 )
 
 func DeleteInfohash(infohash string) error {
@@ -39,14 +36,15 @@ func CheckInfohashExists(infohash string) bool {
 
 	// Check if the infohash key exists in the "Metadata" bucket
 	err := db.View(func(tx *bolt.Tx) error {
-		// Open the bucket
+		// Open the bucket; nothing has been stored yet if it is missing
 		bucket := tx.Bucket([]byte("Metadata"))
 		if bucket == nil {
-			return fmt.Errorf("bucket not found")
+			return nil
 		}
 
-		// Get the value associated with the infohash key
-		metadata := bucket.Get([]byte(infohash))
+		// Get the value associated with the infohash key, which may be the
+		// other infohash of a hybrid torrent
+		metadata := bucket.Get([]byte(resolveInfohash(tx, infohash)))
 		exists = metadata != nil // If metadata is nil, the key doesn't exist
 		return nil
 	})
@@ -70,7 +68,7 @@ func ShowMetadataForInfohash(infohash string)([]byte){
 			return fmt.Errorf("bucket not found")
 		}
 		// Retrieve metadata by the infohash key
-		metadata := bucket.Get([]byte(infohash))
+		metadata := bucket.Get([]byte(resolveInfohash(tx, infohash)))
 		if metadata == nil {
 			fmt.Println("No metadata found for infohash:", infohash)
 			return nil
@@ -125,63 +123,12 @@ func ShowInfohashes()([]string){
 	return infohashes
 }
 
-type File struct {
-	Length	int	`bencode:"length"`
-	Path	[]string	`bencode:"path"`
-}
-
-type MetaData struct {
-	Files	[]File	`bencode:"files"`
-}
-
-type Pieces string
-
+// ParseMetadata returns the name and file paths of raw info dictionary bytes.
+// Use ParseTorrent for the full decoded model.
 func ParseMetadata(metadata []byte) (string, []string) {
-	// Initialize return values
-	var name string
-	var files []string
-
-	// Find the "4:name" key in the metadata
-	metaNameIndex := bytes.Index(metadata, []byte("4:name"))
-	if metaNameIndex != -1 {
-		// Extract the length of the name
-		colonIndex := metaNameIndex + len("4:name")
-		nameLengthStart := colonIndex
-		nameLengthEnd := bytes.IndexByte(metadata[nameLengthStart:], ':') + nameLengthStart
-		nameLengthStr := string(metadata[nameLengthStart:nameLengthEnd])
-
-		// Convert the length to an integer
-		nameLength, err := strconv.Atoi(nameLengthStr)
-		if err != nil {
-			// Return empty if there's an error with parsing the length
-			return name, files
-		}
-
-		// Extract the name based on the length
-		nameStart := nameLengthEnd + 1
-		name = string(metadata[nameStart : nameStart+nameLength])
-	}
-
-	// Attempt to parse the "files" section
-	metaFilesIndexStart := bytes.Index(metadata, []byte("5:files"))
-	if metaFilesIndexStart != -1 {
-		metaFilesIndexEnd := bytes.Index(metadata, []byte("4:name"))
-		if metaFilesIndexEnd == -1{
-			return name, files
-		}
-		metaFiles := metadata[metaFilesIndexStart:metaFilesIndexEnd]
-		filesData := make([]byte,len(metaFiles))
-		copy(filesData,metaFiles)
-		// fmt.Println(string(filesData))
-		filesData = append([]byte("d"),filesData...)
-		filesData = append(filesData, byte('e'))
-		var metaFilesDict MetaData
-		if err := bencode.Unmarshal(bytes.NewReader(filesData), &metaFilesDict); err == nil {
-			for _, file := range metaFilesDict.Files {
-				files = append(files, file.Path...)
-			}
-		}
+	t, err := ParseTorrent("", metadata)
+	if err != nil {
+		return "", nil
 	}
-
-	return name, files
+	return t.Name, t.FilePaths()
 }
@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bootstrap configuration
+const (
+	bootstrapEnvRouters = "DHT_BOOTSTRAP"       // Comma-separated host:port list replacing the routers
+	bootstrapEnvFiles   = "DHT_BOOTSTRAP_FILES" // Comma-separated node files added to the sources
+	bootstrapEnvSaved   = "DHT_BOOTSTRAP_SAVED" // "0" or "false" disables the saved node table
+	bootstrapCacheTTL   = 10 * time.Minute
+)
+
+// Public bootstrap routers used when nothing else is configured
+var defaultBootstrapRouters = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// BootstrapConfig describes where the crawler finds its first nodes
+type BootstrapConfig struct {
+	// Routers are host:port entries; hostnames are resolved to every
+	// address they have and literal IP:port entries are used as-is
+	Routers []string
+	// Files list nodes one per line as "ip:port" or "<hex node ID> ip:port".
+	// Blank lines and lines starting with # are ignored.
+	Files []string
+	// UseSavedNodes seeds the crawl from the node table saved by the
+	// previous run
+	UseSavedNodes bool
+}
+
+// Bootstrap is the configuration used by CrawlDHT and Peers. It can be
+// replaced before crawling starts, for example to point the crawler at a
+// private test DHT, and is overridden by the DHT_BOOTSTRAP,
+// DHT_BOOTSTRAP_FILES and DHT_BOOTSTRAP_SAVED environment variables.
+var Bootstrap = BootstrapConfig{
+	Routers:       defaultBootstrapRouters,
+	UseSavedNodes: true,
+}
+
+// withEnv applies the environment overrides to a configuration
+func (c BootstrapConfig) withEnv() BootstrapConfig {
+	if routers := splitList(os.Getenv(bootstrapEnvRouters)); len(routers) > 0 {
+		c.Routers = routers
+	}
+	c.Files = append(append([]string{}, c.Files...), splitList(os.Getenv(bootstrapEnvFiles))...)
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(bootstrapEnvSaved))) {
+	case "0", "false", "no":
+		c.UseSavedNodes = false
+	}
+	return c
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// addresses resolves the routers and reads the node files, returning the
+// deduplicated node addresses. Unreadable files and unresolvable hosts are
+// skipped so that one bad source does not stop the crawl.
+func (c BootstrapConfig) addresses() []string {
+	seen := make(map[string]struct{})
+	var addresses []string
+	add := func(address string) {
+		if _, ok := seen[address]; !ok {
+			seen[address] = struct{}{}
+			addresses = append(addresses, address)
+		}
+	}
+
+	for _, router := range c.Routers {
+		for _, address := range resolveRouter(router) {
+			add(address)
+		}
+	}
+	for _, path := range c.Files {
+		nodes, err := readNodesFile(path)
+		if err != nil {
+			continue
+		}
+		for _, address := range nodes {
+			add(address)
+		}
+	}
+	return addresses
+}
+
+// resolveRouter expands a host:port entry to one IP:port per address of
+// the host. Unresolvable hosts are returned unchanged so the transport can
+// retry the lookup when it queries them.
+func resolveRouter(router string) []string {
+	host, port, err := net.SplitHostPort(router)
+	if err != nil {
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{router}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return []string{router}
+	}
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	return addresses
+}
+
+// readNodesFile reads a bootstrap node file
+func readNodesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bootstrap file: %v", err)
+	}
+	defer f.Close()
+
+	var addresses []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		address := fields[len(fields)-1]
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap file: %v", err)
+	}
+	return addresses, nil
+}
+
+// bootstrapCache keeps the resolved bootstrap addresses so that lookups
+// falling back to them do not resolve hosts and read files every time
+var bootstrapCache struct {
+	sync.Mutex
+	addresses []string
+	resolved  time.Time
+}
+
+// bootstrapAddresses returns the configured routers and file nodes
+func bootstrapAddresses() []string {
+	bootstrapCache.Lock()
+	defer bootstrapCache.Unlock()
+	if bootstrapCache.addresses == nil || time.Since(bootstrapCache.resolved) > bootstrapCacheTTL {
+		bootstrapCache.addresses = Bootstrap.withEnv().addresses()
+		bootstrapCache.resolved = time.Now()
+	}
+	return bootstrapCache.addresses
+}
+
+// seedAddresses returns every node the crawl should start from: the saved
+// node table, if enabled, followed by the routers and node files.
+func seedAddresses() []string {
+	var addresses []string
+	if Bootstrap.withEnv().UseSavedNodes {
+		addresses = restoreNodes()
+	}
+	return append(addresses, bootstrapAddresses()...)
+}
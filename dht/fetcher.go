@@ -0,0 +1,181 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Metadata fetcher configuration
+const (
+	maxFetchPeers  = 5                // Peers tried concurrently per infohash
+	failedPeerTTL  = 30 * time.Minute // How long a peer that failed is not retried for an infohash
+	maxFailedPeers = 100000
+)
+
+// fetchJob fetches the metadata of one infohash from the peers given to it,
+// trying up to maxFetchPeers at once and cancelling the rest once one of
+// them succeeds. All fields are guarded by the fetcher's mutex.
+type fetchJob struct {
+	infohash string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	pending  []string
+	tried    map[string]bool
+	active   int
+	claimed  bool          // A peer delivered the metadata and it is being stored
+	done     chan struct{} // Closed when the job finishes
+	err      error         // Last peer error while running, the result once done
+}
+
+// wait blocks until the job finishes or ctx is cancelled
+func (j *fetchJob) wait(ctx context.Context) error {
+	select {
+	case <-j.done:
+		return j.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// metadataFetcher runs one fetchJob per infohash across the whole crawler,
+// so concurrent requests for the same infohash share a single fetch
+type metadataFetcher struct {
+	mu     sync.Mutex
+	ctx    context.Context // Parent of the jobs' contexts
+	jobs   map[string]*fetchJob
+	failed map[string]time.Time // When a peer failed, keyed by peer + infohash
+}
+
+var fetcher = &metadataFetcher{
+	ctx:    context.Background(),
+	jobs:   make(map[string]*fetchJob),
+	failed: make(map[string]time.Time),
+}
+
+// bind derives the contexts of the jobs started from now on from ctx, so
+// that CrawlDHT's fetches stop when the crawl does
+func (f *metadataFetcher) bind(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ctx = ctx
+}
+
+// FetchMetadata fetches, stores and indexes the metadata for infohash (hex)
+// from peers, joining the fetch already in flight for it if there is one.
+// It returns once the metadata is stored, every peer has failed, or ctx is
+// cancelled; in the last case the fetch carries on for any other waiters.
+func FetchMetadata(ctx context.Context, infohash string, peers ...string) error {
+	return fetcher.fetch(infohash, peers...).wait(ctx)
+}
+
+// fetch returns the job for infohash, starting one if none is running, and
+// gives it the peers it has not tried yet
+func (f *metadataFetcher) fetch(infohash string, peers ...string) *fetchJob {
+	exists := CheckInfohashExists(infohash)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[infohash]
+	if !ok {
+		ctx, cancel := context.WithCancel(f.ctx)
+		job = &fetchJob{
+			infohash: infohash,
+			ctx:      ctx,
+			cancel:   cancel,
+			tried:    make(map[string]bool),
+			done:     make(chan struct{}),
+		}
+		if exists {
+			f.finish(job, nil)
+			return job
+		}
+		f.jobs[infohash] = job
+	}
+
+	now := time.Now()
+	for _, peer := range peers {
+		if peer == "" || job.tried[peer] {
+			continue
+		}
+		if failedAt, ok := f.failed[peer+"/"+infohash]; ok && now.Sub(failedAt) < failedPeerTTL {
+			continue
+		}
+		job.tried[peer] = true
+		job.pending = append(job.pending, peer)
+	}
+	f.startWorkers(job)
+	if job.active == 0 && !job.claimed {
+		f.finish(job, fmt.Errorf("no peers to fetch metadata for %s from", infohash))
+	}
+	return job
+}
+
+// startWorkers starts a worker per pending peer, up to maxFetchPeers. Callers
+// hold f.mu.
+func (f *metadataFetcher) startWorkers(job *fetchJob) {
+	for !job.claimed && job.active < maxFetchPeers && len(job.pending) > 0 {
+		peer := job.pending[0]
+		job.pending = job.pending[1:]
+		job.active++
+		go f.work(job, peer)
+	}
+}
+
+// work fetches the metadata from one peer. The first peer to deliver it
+// claims the job, cancels the other workers and stores the metadata.
+func (f *metadataFetcher) work(job *fetchJob, peer string) {
+	metadata, err := downloadMetadata(job.ctx, peer, job.infohash)
+
+	f.mu.Lock()
+	job.active--
+	if err == nil && !job.claimed {
+		job.claimed = true
+		job.cancel()
+		f.mu.Unlock()
+
+		err = storeMetadata(job.infohash, metadata)
+
+		f.mu.Lock()
+		f.finish(job, err)
+		f.mu.Unlock()
+		return
+	}
+	defer f.mu.Unlock()
+	if job.claimed {
+		return
+	}
+	f.recordFailure(peer, job.infohash)
+	job.err = err
+	f.startWorkers(job)
+	if job.active == 0 {
+		f.finish(job, fmt.Errorf("failed to fetch metadata for %s: %v", job.infohash, job.err))
+	}
+}
+
+// recordFailure remembers that peer failed to deliver infohash. Callers
+// hold f.mu.
+func (f *metadataFetcher) recordFailure(peer, infohash string) {
+	now := time.Now()
+	if len(f.failed) >= maxFailedPeers {
+		for key, failedAt := range f.failed {
+			if now.Sub(failedAt) >= failedPeerTTL {
+				delete(f.failed, key)
+			}
+		}
+	}
+	if len(f.failed) < maxFailedPeers {
+		f.failed[peer+"/"+infohash] = now
+	}
+}
+
+// finish completes a job with its result. Callers hold f.mu.
+func (f *metadataFetcher) finish(job *fetchJob, err error) {
+	if f.jobs[job.infohash] == job {
+		delete(f.jobs, job.infohash)
+	}
+	job.cancel()
+	job.err = err
+	close(job.done)
+}
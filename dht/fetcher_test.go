@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchJobContext(t *testing.T) {
+	useTestDB(t)
+	f := &metadataFetcher{
+		ctx:    context.Background(),
+		jobs:   make(map[string]*fetchJob),
+		failed: make(map[string]time.Time),
+	}
+	crawl, stop := context.WithCancel(context.Background())
+	f.bind(crawl)
+
+	job := f.fetch(strings.Repeat("ab", 20), "127.0.0.1:1")
+	if err := job.ctx.Err(); err != nil {
+		t.Fatalf("job context done before the crawl stopped: %v", err)
+	}
+	stop()
+	if err := job.ctx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("job context not cancelled with the crawl: %v", err)
+	}
+	<-job.done
+}
@@ -1,15 +1,13 @@
 package dht
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"sync"
 	// "log"
 	"net"
+	"strconv"
 	"time"
-
-	"github.com/jackpal/bencode-go"
 )
 
 // Structs for the KRPC find_node request and response
@@ -18,85 +16,89 @@ type FindNodeReq struct {
 	Y string `bencode:"y"`
 	Q string `bencode:"q"`
 	A struct {
-		ID     string `bencode:"id"`
-		Target string `bencode:"target"`
+		ID     string   `bencode:"id"`
+		Target string   `bencode:"target"`
+		Want   []string `bencode:"want,omitempty"` // Address families wanted (BEP 32)
 	} `bencode:"a"`
 }
 
 type FindNodeResp struct {
-	IP string `bencode:"ip"`
+	IP string `bencode:"ip,omitempty"`
 	R  struct {
-		ID    string `bencode:"id"`
-		Nodes string `bencode:"nodes"` // Compact node info
+		ID     string `bencode:"id"`
+		Nodes  string `bencode:"nodes,omitempty"`  // Compact node info
+		Nodes6 string `bencode:"nodes6,omitempty"` // Compact IPv6 node info
 	} `bencode:"r"`
 	T string `bencode:"t"`
 	Y string `bencode:"y"`
 }
 
-// Bootstrap DHT nodes
-var bootstrapNodes = []string{
-	"router.bittorrent.com:6881",
-	"router.utorrent.com:6881",
-	"dht.transmissionbt.com:6881",
+// Function to parse the compact node info (node ID + IP:port) from the response
+func parseCompactNodes(compact string) []Node {
+	return parseCompactNodeList(compact, net.IPv4len)
+}
+
+// Function to parse the compact IPv6 node info from the nodes6 field (BEP 32)
+func parseCompactNodes6(compact string) []Node {
+	return parseCompactNodeList(compact, net.IPv6len)
 }
 
-// Function to parse the compact node info from the response
-func parseCompactNodes(compact string) []string {
-	var nodes []string
-	for i := 0; i < len(compact); i += 26 {
-		node := compact[i : i+26]
-		ip := net.IP(node[20:24])
-		port := int(node[24])<<8 | int(node[25])
-		nodes = append(nodes, fmt.Sprintf("%s:%d", ip.String(), port))
+func parseCompactNodeList(compact string, ipLen int) []Node {
+	var nodes []Node
+	size := nodeIDLength + ipLen + 2
+	for i := 0; i+size <= len(compact); i += size {
+		node := compact[i : i+size]
+		id, _ := nodeIDFromString(node[:nodeIDLength])
+		ip := net.IP(node[nodeIDLength : nodeIDLength+ipLen])
+		if blockedIP(ip) {
+			continue
+		}
+		port := int(node[size-2])<<8 | int(node[size-1])
+		nodes = append(nodes, Node{ID: id, Addr: net.JoinHostPort(ip.String(), strconv.Itoa(port))})
 	}
 	return nodes
 }
 
-// Function to send the find_node request to a DHT node
-func sendFindNodeRequest(target, nodeID, address string) ([]string, error) {
-	// Create the request
-	req := FindNodeReq{T: "aa", Y: "q", Q: "find_node"}
-	req.A.ID = nodeID
-	req.A.Target = target
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %v", err)
+// Function to encode a node as compact node info
+func encodeCompactNode(node Node) (string, bool) {
+	peer, ok := encodeCompactPeer(node.Addr)
+	if !ok {
+		return "", false
 	}
+	return node.ID.raw() + peer, true
+}
 
-	// Create UDP connection
-	var d net.Dialer
-	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
-	defer cancel()
-	conn, err := d.DialContext(ctx, "udp4", address)
+func (r *FindNodeReq) setTransactionID(t string) { r.T = t }
+
+// Function to send the find_node request to a DHT node
+func sendFindNodeRequest(target, nodeID, address string) ([]Node, error) {
+	t, err := getTransport()
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial: %v", err)
+		return nil, err
 	}
-	defer conn.Close()
 
-	// Send request
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
+	// Create the request
+	req := FindNodeReq{Y: "q", Q: "find_node"}
+	req.A.ID = nodeID
+	req.A.Target = target
+	req.A.Want = t.want()
 
-	// Read response
-	resp := make([]byte, 65535)
-	conn.SetReadDeadline(time.Now().Add(requestTimeout))
-	_, err = conn.Read(resp)
+	// Send request and wait for the matching response
+	resp, err := t.query(address, &req, requestTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, err
 	}
 
 	// Unmarshal response
 	var response FindNodeResp
-	r := bytes.NewReader(resp)
-	err = bencode.Unmarshal(r, &response)
+	err = decodeBencode(resp, &response)
 	if err != nil {
+		autoBanAddr(address)
 		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
 
 	// Parse and return node list
-	nodes := parseCompactNodes(response.R.Nodes)
+	nodes := append(parseCompactNodes(response.R.Nodes), parseCompactNodes6(response.R.Nodes6)...)
 	return nodes, nil
 }
 
@@ -124,37 +126,54 @@ type NodeInfo struct {
 
 // Improved CrawlDHT with connection pooling and rate limiting
 func CrawlDHT(ctx context.Context) {
-	nodeID := "abcdefghij0123456789"
-	target := "mnopqrstuvwxyz123456"
-	
-	// Use bounded queue for nodes
+	// Use bounded queue for nodes, starting from the nodes saved by the
+	// previous run and the configured bootstrap sources
 	queue := make(chan string, maxQueueSize)
-	for _, node := range bootstrapNodes {
-		queue <- node
+	for _, node := range seedAddresses() {
+		select {
+		case queue <- node:
+		default:
+		}
 	}
 
-	// Start cleanup goroutine
+	// Metadata fetches started by the crawl stop with it
+	fetcher.bind(ctx)
+
+	// Start cleanup, routing table maintenance, sampling, harvest and
+	// persistence goroutines
 	go periodicCleanup()
+	go maintainRoutingTable(ctx, queue)
+	go sampler.run(ctx)
+	go processHarvested(ctx)
+	go persistNodes(ctx)
+	go persistSwarms(ctx)
 
 	var wg sync.WaitGroup
 	for i := 0; i < maxConcurrentConnections; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			select {
-			case address := <-queue:
-				processNode(ctx, address, nodeID, target, queue)
-			case <-ctx.Done():
-				return
+			for {
+				select {
+				case address := <-queue:
+					processNode(ctx, address, queue)
+				case <-ctx.Done():
+					return
+				}
 			}
 		}()
 	}
 
 	wg.Wait()
+
+	// Save the node table so the next run starts warm, and what we learned
+	// about swarms
+	SaveNodes()
+	FlushSwarms()
 }
 
 // Process a single node with proper error handling and backoff
-func processNode(ctx context.Context, address, nodeID, target string, queue chan string) {
+func processNode(ctx context.Context, address string, queue chan string) {
 	// Acquire semaphore
 	select {
     case semaphore <- struct{}{}:
@@ -168,40 +187,43 @@ func processNode(ctx context.Context, address, nodeID, target string, queue chan
 		return
 	}
 
-	// Create context with timeout
-	// ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
-	// defer cancel()
-
-	// Try to establish connection
-	conn, err := createConnection(ctx, address)
-	if err != nil {
-		markNodeFailure(address)
-		return
-	}
-	defer conn.Close()
-
-	// Process find_node request
-	nodes, err := sendFindNodeRequestWithTimeout(conn, target, nodeID)
+	// Process find_node request for a random target so that the returned
+	// nodes spread across the keyspace
+	nodes, err := sendFindNodeRequest(randomNodeID().raw(), localID().raw(), address)
 	if err != nil {
 		markNodeFailure(address)
 		return
 	}
+	markNodeVisited(address)
 
 	// Queue new nodes with bounds checking
+	enqueueNodes(ctx, nodes, queue)
+
+	// Schedule the node for sample_infohashes
+	sampler.add(address)
+}
+
+// Queue discovered nodes for crawling, dropping them if the queue is full
+func enqueueNodes(ctx context.Context, nodes []Node, queue chan string) {
 	for _, node := range nodes {
 		select {
-        case queue <- node:
-        case <-ctx.Done():
-            return
-        }
+		case queue <- node.Addr:
+		case <-ctx.Done():
+			return
+		default:
+			return
+		}
 	}
-
-	// Process infohashes with bounded concurrency
-	processInfohashes(ctx,address, nodeID, target)
 }
 
 // Check if a node is healthy enough to process
 func isNodeHealthy(address string) bool {
+	if blockedAddr(address) {
+		return false
+	}
+	if node, ok := tableForAddr(address).Lookup(address); ok && node.state(time.Now()) == nodeBad {
+		return false
+	}
 	if value, ok := activeNodes.Load(address); ok {
 		nodeInfo := value.(NodeInfo)
 		if nodeInfo.failures > 3 {
@@ -228,56 +250,60 @@ func markNodeFailure(address string) {
 	}
 }
 
-// Create connection with timeout
-func createConnection(ctx context.Context, address string) (net.Conn, error) {
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "udp4", address)
-	if err != nil {
-		return nil, fmt.Errorf("connection failed: %v", err)
-	}
-	return conn, nil
+// Record a successful visit so the node is not re-crawled immediately
+func markNodeVisited(address string) {
+	activeNodes.Store(address, NodeInfo{lastAccessed: time.Now()})
 }
 
-// Process infohashes with proper concurrency control
-func processInfohashes(ctx context.Context,address, nodeID, target string) {
-	infohashes, err := sendSampleInfohashRequest(nodeID, address, target)
-	if err != nil {
-		return
-	}
-
-	// Use bounded worker pool for processing infohashes
-	workerPool := make(chan struct{}, 20)
-	var wg sync.WaitGroup
+// Keep the routing table healthy: ping questionable nodes so they either
+// become good again or go bad and can be replaced, and refresh buckets that
+// have not changed recently with a find_node for a random ID in their range.
+func maintainRoutingTable(ctx context.Context, queue chan string) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	for _, hash := range infohashes {
-		if !CheckInfohashExists(hash) {
-			wg.Add(1)
-			workerPool <- struct{}{} // Acquire worker
-			
-			go func(ih string) {
-				defer wg.Done()
-				defer func() { <-workerPool }() // Release worker
-				
-				// ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-				// defer cancel()
-				
-				done := make(chan struct{})
-				go func() {
-					Peers(ih)
-					close(done)
-				}()
+		for _, table := range []*RoutingTable{routingTable, routingTable6} {
+			for _, node := range table.Questionable() {
+				go sendPing(localID().raw(), node.Addr)
+			}
 
-				select {
-				case <-ctx.Done():
-					// log.Printf("Timeout processing infohash: %s", ih)
-				case <-done:
-					// Successfully processed
+			for _, target := range table.StaleBuckets() {
+				for _, node := range table.Closest(target, 3) {
+					go func(address string, target NodeID) {
+						nodes, err := sendFindNodeRequest(target.raw(), localID().raw(), address)
+						if err == nil {
+							enqueueNodes(ctx, nodes, queue)
+						}
+					}(node.Addr, target)
 				}
-			}(hash)
+			}
 		}
 	}
+}
 
-	wg.Wait()
+// Look up peers for an infohash and fetch its metadata from them, several
+// at a time, through the shared fetcher
+func lookupAndFetch(ctx context.Context, infohash string, known ...string) error {
+	// Peers already known to have the infohash are tried while the lookup
+	// runs
+	if len(known) > 0 {
+		fetcher.fetch(infohash, known...)
+	}
+	result, err := Peers(infohash)
+	if err != nil && len(known) == 0 {
+		return err
+	}
+	var peers []string
+	if result != nil {
+		peers = result.Peers
+	}
+	return FetchMetadata(ctx, infohash, peers...)
 }
 
 // Periodic cleanup of inactive nodes
@@ -292,29 +318,7 @@ func periodicCleanup() {
 			}
 			return true
 		})
-	}
-}
-
-// Additional helper function to enforce timeouts on find_node requests
-func sendFindNodeRequestWithTimeout(conn net.Conn, target, nodeID string) ([]string, error) {
-	done := make(chan []string, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		nodes, err := sendFindNodeRequest(target, nodeID, conn.RemoteAddr().String())
-		if err != nil {
-			errChan <- err
-			return
-		}
-		done <- nodes
-	}()
-
-	select {
-	case nodes := <-done:
-		return nodes, nil
-	case err := <-errChan:
-		return nil, err
-	case <-time.After(requestTimeout):
-		return nil, fmt.Errorf("request timed out")
+		limiter.prune(cleanupInterval)
+		sampler.pruneSupport()
 	}
 }
@@ -1,20 +1,21 @@
 package dht
 
 import (
-	"bytes"
-	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	// "log"
 	"net"
-	"sync"
-	"time"
-
-	"github.com/jackpal/bencode-go"
+	"sort"
+	"strconv"
 )
 
-var unique sync.Map
+// Lookup configuration
+const (
+	lookupAlpha      = 3 // Parallel queries in flight
+	lookupK          = bucketSize
+	maxLookupQueries = 200 // Hard cap on queries per lookup
+)
 
 // Request structure for get_peers
 type GetPeersReq struct {
@@ -22,146 +23,299 @@ type GetPeersReq struct {
 	Y string `bencode:"y"` // Query type (should be 'q')
 	Q string `bencode:"q"` // Query method (should be 'get_peers"`
 	A struct {
-		ID       string `bencode:"id"`        // Your node's ID
-		InfoHash string `bencode:"info_hash"` // The target infohash
+		ID       string   `bencode:"id"`               // Your node's ID
+		InfoHash string   `bencode:"info_hash"`        // The target infohash
+		Want     []string `bencode:"want,omitempty"`   // Address families wanted (BEP 32)
+		Scrape   int      `bencode:"scrape,omitempty"` // Ask for seeder and downloader filters (BEP 33)
 	} `bencode:"a"`
 }
 
 // Response structure for get_peers
 type GetPeersResp struct {
 	R struct {
-		ID     string   `bencode:"id"`     // Queried node's ID
-		Token  string   `bencode:"token"`  // Token for announce_peer
-		Nodes  string   `bencode:"nodes"`  // Compact node info (optional)
-		Values []string `bencode:"values"` // List of peers (optional)
+		ID     string   `bencode:"id"`               // Queried node's ID
+		Token  string   `bencode:"token"`            // Token for announce_peer
+		Nodes  string   `bencode:"nodes,omitempty"`  // Compact node info (optional)
+		Nodes6 string   `bencode:"nodes6,omitempty"` // Compact IPv6 node info (optional)
+		Values []string `bencode:"values,omitempty"` // List of peers (optional)
+		BFsd   string   `bencode:"BFsd,omitempty"`   // Bloom filter of seeders (BEP 33, optional)
+		BFpe   string   `bencode:"BFpe,omitempty"`   // Bloom filter of downloaders (BEP 33, optional)
 	} `bencode:"r"`
 	T string `bencode:"t"` // Transaction ID
 	Y string `bencode:"y"` // Response type (should be 'r')
 }
 
-// Decode compact peer info (IP:Port)
-func decodeCompactPeers(peers []string, infohash string){
-	// fmt.Println("Got peers")
-	// var wg sync.WaitGroup
+// Decode compact peer info (IP:Port), 6 bytes for IPv4 or 18 for IPv6
+func decodeCompactPeers(peers []string) []string {
+	var addresses []string
 	for _, peer := range peers {
-		if len(peer) != 6 {
+		if len(peer) != 6 && len(peer) != 18 {
 			// fmt.Println("Invalid peer length:", len(peer))
 			continue
 		}
-		ip := net.IP(peer[:4])                            // First 4 bytes are the IP address
-		port := binary.BigEndian.Uint16([]byte(peer[4:6])) // Last 2 bytes are the port
-		address := fmt.Sprintf("%s:%d", ip, port)
-		if _, loaded := unique.LoadOrStore(address, struct{}{}); loaded {
+		ipLen := len(peer) - 2
+		ip := net.IP(peer[:ipLen]) // Leading 4 or 16 bytes are the IP address
+		if blockedIP(ip) {
 			continue
 		}
-		unique.Store(address, struct{}{})
-		// fmt.Println(infohash)
-		// fmt.Printf("Peer IP: %s, Port: %d\n", ip, port)
-		if !CheckInfohashExists(infohash){
-			// log.Printf("Infohash: %s, Peer IP: %s, Port: %d\n",infohash, ip, port)
-			// wg.Add(1)
-			// go func(addr, ih string) {
-			// 	defer wg.Done()
-				Metadata(address,infohash)
-			// }(address,infohash)
-		}
+		port := binary.BigEndian.Uint16([]byte(peer[ipLen:])) // Last 2 bytes are the port
+		addresses = append(addresses, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
 	}
-	// wg.Wait()
+	return addresses
 }
 
-// Decode compact node info (NodeID, IP:Port)
-func decodeCompactNodes(nodes string,infohash string) {
-	const nodeInfoLength = 26 // 20 bytes NodeID + 6 bytes IP:Port
-	for i := 0; i+nodeInfoLength <= len(nodes); i += nodeInfoLength {
-		// nodeID := nodes[i : i+20]                     // NodeID is 20 bytes
-		ip := net.IP(nodes[i+20 : i+24])              // 4 bytes for IPv4 address
-		port := binary.BigEndian.Uint16([]byte(nodes[i+24 : i+26])) // 2 bytes for the port
-		// fmt.Printf("NodeID: %x, IP: %s, Port: %d\n", nodeID, ip, port)
-		address := fmt.Sprintf("%s:%d", ip, port)
-		if _, loaded := unique.LoadOrStore(address, struct{}{}); loaded {
-			continue
-		}
-		unique.Store(address, struct{}{})
-		getPeer(address, infohash) // Recursively query the node
+// Encode an IP:Port address as compact peer info
+func encodeCompactPeer(address string) (string, bool) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return "", false
 	}
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], uint16(port))
+	return string(buf), true
 }
 
-func getPeer(address string, infohash string) {
-	// Create the request for get_peers
-	req := GetPeersReq{T: "aa", Y: "q", Q: "get_peers"}
-	req.A.ID = "abcdefghij0123456789" // Your node's ID
+func (r *GetPeersReq) setTransactionID(t string) { r.T = t }
 
-	// Decode the InfoHash from hex string
-	infoHashBytes, err := hex.DecodeString(infohash)
+// Send a single get_peers query to a DHT node
+func getPeer(address string, infohash string) (*GetPeersResp, error) {
+	t, err := getTransport()
 	if err != nil {
-		// log.Fatalf("Invalid info hash: %v\n", err)
+		return nil, err
 	}
-	req.A.InfoHash = string(infoHashBytes)
 
-	var buf bytes.Buffer
-	err = bencode.Marshal(&buf, req)
+	// Create the request for get_peers
+	req := GetPeersReq{Y: "q", Q: "get_peers"}
+	req.A.ID = localID().raw() // Your node's ID
+	req.A.InfoHash = infohash
+	req.A.Want = t.want()
+	req.A.Scrape = 1
+
+	// Send get_peers request and wait for the matching response
+	resp, err := t.query(address, &req, requestTimeout)
 	if err != nil {
-		// log.Fatalf("Failed to marshal get_peers request: %v\n", err)
+		return nil, err
 	}
 
-	// Create UDP connection to DHT node
-	var d net.Dialer
-	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
-	defer cancel()
-	conn, err := d.DialContext(ctx, "udp4", address)
+	// Unmarshal response
+	var response GetPeersResp
+	err = decodeBencode(resp, &response)
 	if err != nil {
-		// fmt.Printf("Failed to dial: %v\n", err)
-		return
+		autoBanAddr(address)
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
-	defer conn.Close()
+	return &response, nil
+}
 
-	// Send get_peers request
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		// fmt.Printf("Failed to send get_peers request: %v\n", err)
-		return
+// PeersResult is the outcome of an iterative get_peers lookup
+type PeersResult struct {
+	Infohash string
+	Peers    []string          // Peer addresses (IP:Port) returned in values
+	Tokens   map[string]string // Announce token per responding node address
+	Nodes    []Node            // Closest nodes to the infohash that responded
+	Scraped  bool              // Whether any of the closest nodes returned BEP 33 filters
+	Seeders  int               // Estimated seeders, if Scraped
+	Leechers int               // Estimated downloaders, if Scraped
+}
+
+// lookupCandidate is a node in the lookup shortlist
+type lookupCandidate struct {
+	Node
+	queried   bool
+	responded bool
+	failed    bool
+}
+
+// lookupReply is the outcome of one query made during a lookup
+type lookupReply[R any] struct {
+	candidate *lookupCandidate
+	resp      R
+	err       error
+}
+
+// iterativeLookup walks the DHT towards target. It keeps a shortlist
+// ordered by XOR distance to the target, sends query to lookupAlpha nodes at
+// a time and stops once the lookupK closest nodes have all responded or
+// handle asks it to. handle runs on the calling goroutine for each reply and
+// returns the responding node's ID and the nodes it returned. The closest
+// nodes that responded are returned.
+func iterativeLookup[R any](target NodeID, query func(address string) (R, error),
+	handle func(address string, resp R) (id string, nodes []Node, stop bool)) []Node {
+	shortlist := make(map[string]*lookupCandidate)
+	var ordered []*lookupCandidate
+
+	addCandidate := func(node Node) {
+		if _, ok := shortlist[node.Addr]; ok {
+			return
+		}
+		c := &lookupCandidate{Node: node}
+		shortlist[node.Addr] = c
+		ordered = append(ordered, c)
 	}
 
-	// Read response
-	resp := make([]byte, 65535) // Large buffer for response
-	conn.SetReadDeadline(time.Now().Add(requestTimeout)) // 10-second timeout
-	n, err := conn.Read(resp)
-	if err != nil {
-		// fmt.Printf("Failed to read response: %v\n", err)
-		return
+	// Seed from the routing table, falling back to the bootstrap nodes
+	// whose IDs are unknown. Those are given the farthest possible ID so
+	// that any real candidate is preferred over them.
+	for _, node := range closestNodes(target, lookupK) {
+		addCandidate(node)
+	}
+	if len(ordered) < lookupK {
+		var farthest NodeID
+		for i := range farthest {
+			farthest[i] = ^target[i]
+		}
+		for _, address := range bootstrapAddresses() {
+			addCandidate(Node{ID: farthest, Addr: address})
+		}
 	}
-	resp = resp[:n] // Trim the response to actual size
 
-	// Print raw response for debugging (optional)
-	// fmt.Printf("Raw response (hex): %s\n", hex.EncodeToString(resp))
+	// Buffered for every query so that stragglers never block once the
+	// lookup has stopped early
+	replies := make(chan lookupReply[R], maxLookupQueries)
+	inFlight := 0
+	queries := 0
 
-	// Unmarshal response
-	var response GetPeersResp
-	r := bytes.NewReader(resp)
-	err = bencode.Unmarshal(r, &response)
-	if err != nil {
-		// fmt.Printf("Failed to unmarshal response: %v\n", err)
-		return
-	}
-	// fmt.Println(response.R.Token)
-	if len(response.R.Values) > 0 {
-		// fmt.Printf("Peers:\n")
-		decodeCompactPeers(response.R.Values,infohash)
-	} else if response.R.Nodes != "" {
-		// fmt.Printf("Nodes:\n")
-		decodeCompactNodes(response.R.Nodes,infohash)
-	} else {
-		// fmt.Println("No peers or nodes found.")
+	for {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].ID.closerTo(target, ordered[j].ID)
+		})
+
+		// Count the closest live candidates; the lookup is done when all of
+		// the lookupK closest have responded.
+		live, converged := 0, true
+		for _, c := range ordered {
+			if c.failed {
+				continue
+			}
+			if !c.responded {
+				converged = false
+			}
+			live++
+			if live == lookupK {
+				break
+			}
+		}
+		if converged && inFlight == 0 {
+			break
+		}
+
+		// Launch queries to the closest unqueried candidates
+		live = 0
+		for _, c := range ordered {
+			if inFlight >= lookupAlpha || queries >= maxLookupQueries || live >= lookupK {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			live++
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inFlight++
+			queries++
+			go func(c *lookupCandidate) {
+				resp, err := query(c.Addr)
+				replies <- lookupReply[R]{candidate: c, resp: resp, err: err}
+			}(c)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		reply := <-replies
+		inFlight--
+		c := reply.candidate
+		if reply.err != nil {
+			c.failed = true
+			continue
+		}
+		c.responded = true
+		id, nodes, stop := handle(c.Addr, reply.resp)
+		if nodeID, ok := nodeIDFromString(id); ok {
+			c.ID = nodeID
+		}
+		for _, node := range nodes {
+			addCandidate(node)
+		}
+		if stop {
+			break
+		}
 	}
+
+	var closest []Node
+	for _, c := range ordered {
+		if c.responded {
+			closest = append(closest, c.Node)
+			if len(closest) == lookupK {
+				break
+			}
+		}
+	}
+	return closest
 }
 
+// Peers performs an iterative get_peers lookup for the hex-encoded
+// infohash, collecting the peers and announce tokens the nodes return. The
+// swarm size is estimated from the BEP 33 filters of the closest nodes
+// that responded, which are the ones that store the infohash's peers.
+func Peers(infohash string) (*PeersResult, error) {
+	infoHashBytes, err := hex.DecodeString(infohash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid infohash: %v", err)
+	}
+	target, ok := nodeIDFromString(string(infoHashBytes))
+	if !ok {
+		return nil, fmt.Errorf("invalid infohash length: %d", len(infoHashBytes))
+	}
+
+	result := &PeersResult{Infohash: infohash, Tokens: make(map[string]string)}
+	seenPeers := make(map[string]struct{})
+	filters := make(map[string][2]string) // Seeder and downloader filters per responder
+
+	query := func(address string) (*GetPeersResp, error) {
+		return getPeer(address, target.raw())
+	}
+	handle := func(address string, resp *GetPeersResp) (string, []Node, bool) {
+		if resp.R.Token != "" {
+			result.Tokens[address] = resp.R.Token
+		}
+		for _, peer := range decodeCompactPeers(resp.R.Values) {
+			if _, ok := seenPeers[peer]; !ok {
+				seenPeers[peer] = struct{}{}
+				result.Peers = append(result.Peers, peer)
+			}
+		}
+		if resp.R.BFsd != "" || resp.R.BFpe != "" {
+			filters[address] = [2]string{resp.R.BFsd, resp.R.BFpe}
+		}
+		nodes := append(parseCompactNodes(resp.R.Nodes), parseCompactNodes6(resp.R.Nodes6)...)
+		return resp.R.ID, nodes, false
+	}
+	result.Nodes = iterativeLookup(target, query, handle)
 
-func Peers(infohash string) {
-	var bootstrapNodes = []string{
-		"router.bittorrent.com:6881",
-		"dht.transmissionbt.com:6881",
-		"router.utorrent.com:6881",
+	var scrape scrapeResult
+	for _, node := range result.Nodes {
+		if filter, ok := filters[node.Addr]; ok {
+			scrape.add(filter[0], filter[1])
+		}
 	}
-	for _, node := range bootstrapNodes {
-		getPeer(node,infohash)
+	if scrape.responses > 0 {
+		result.Scraped = true
+		result.Seeders = scrape.seeders.estimate()
+		result.Leechers = scrape.leechers.estimate()
+		swarms.observeScrape(infohash, result.Seeders, result.Leechers)
 	}
-}
\ No newline at end of file
+	swarms.observeLookup(infohash, result.Peers)
+	return result, nil
+}
@@ -0,0 +1,244 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// useLookupTables replaces the routing tables with ones holding nodes and
+// the bootstrap routers with bootstrap, for the test
+func useLookupTables(t *testing.T, bootstrap string, nodes ...Node) {
+	t.Helper()
+	saved4, saved6 := routingTable, routingTable6
+	routingTable = NewRoutingTable(NodeID{0xff})
+	routingTable6 = NewRoutingTable(NodeID{0xff})
+	for _, n := range nodes {
+		routingTable.Insert(n.ID, n.Addr)
+	}
+	t.Setenv(bootstrapEnvRouters, bootstrap)
+	resetBootstrapCache := func() {
+		bootstrapCache.Lock()
+		bootstrapCache.addresses = nil
+		bootstrapCache.Unlock()
+	}
+	resetBootstrapCache()
+	t.Cleanup(func() {
+		routingTable, routingTable6 = saved4, saved6
+		resetBootstrapCache()
+	})
+}
+
+// testNetwork is a synthetic keyspace of nodes, each knowing up to
+// bucketSize others per bucket as its routing table would
+type testNetwork struct {
+	nodes    []Node
+	byAddr   map[string]Node
+	contacts map[string][]Node
+}
+
+func newTestNetwork(rng *rand.Rand, n int) *testNetwork {
+	network := &testNetwork{byAddr: make(map[string]Node), contacts: make(map[string][]Node)}
+	for i := 0; i < n; i++ {
+		var id NodeID
+		rng.Read(id[:])
+		node := Node{ID: id, Addr: fmt.Sprintf("10.%d.%d.%d:6881", i>>16, i>>8&0xff, i&0xff)}
+		network.nodes = append(network.nodes, node)
+		network.byAddr[node.Addr] = node
+	}
+	for _, node := range network.nodes {
+		perBucket := make(map[int]int)
+		for _, other := range network.nodes {
+			i := node.ID.commonPrefixLen(other.ID)
+			if other.Addr == node.Addr || perBucket[i] >= bucketSize {
+				continue
+			}
+			perBucket[i]++
+			network.contacts[node.Addr] = append(network.contacts[node.Addr], other)
+		}
+	}
+	return network
+}
+
+// closestTo returns the lookupK nodes closest to target among nodes
+func closestTo(target NodeID, nodes []Node) []Node {
+	sorted := append([]Node(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID.closerTo(target, sorted[j].ID)
+	})
+	if len(sorted) > lookupK {
+		sorted = sorted[:lookupK]
+	}
+	return sorted
+}
+
+func TestIterativeLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(i int) bool // Nodes that never answer, by index
+		stop bool             // Stop at the reply of the node closest to the target
+	}{
+		{name: "converges on the k closest"},
+		{name: "skips nodes that do not answer", fail: func(i int) bool { return i%3 == 1 }},
+		{name: "stops when asked", stop: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			network := newTestNetwork(rng, 300)
+			var target NodeID
+			rng.Read(target[:])
+			useLookupTables(t, network.nodes[0].Addr)
+
+			failed := make(map[string]bool)
+			var live []Node
+			for i, node := range network.nodes {
+				if tt.fail != nil && tt.fail(i) {
+					failed[node.Addr] = true
+				} else {
+					live = append(live, node)
+				}
+			}
+			want := closestTo(target, live)
+
+			var mu sync.Mutex
+			queries := 0
+			query := func(address string) ([]Node, error) {
+				mu.Lock()
+				queries++
+				mu.Unlock()
+				if failed[address] {
+					return nil, errors.New("timed out")
+				}
+				return closestTo(target, network.contacts[address]), nil
+			}
+			stopped := false
+			handle := func(address string, nodes []Node) (string, []Node, bool) {
+				if stopped {
+					t.Errorf("reply from %s handled after stopping", address)
+				}
+				stopped = tt.stop && address == want[0].Addr
+				return network.byAddr[address].ID.raw(), nodes, stopped
+			}
+
+			got := iterativeLookup(target, query, handle)
+			// Queries still in flight after an early stop keep counting
+			mu.Lock()
+			if queries > maxLookupQueries {
+				t.Errorf("%d queries, cap is %d", queries, maxLookupQueries)
+			}
+			mu.Unlock()
+			if tt.stop {
+				if !stopped || len(got) == 0 || got[0].Addr != want[0].Addr {
+					t.Errorf("stopped = %v, closest = %v", stopped, got)
+				}
+				return
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d nodes, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].Addr != want[i].Addr || got[i].ID != want[i].ID {
+					t.Errorf("closest[%d] = %s, want %s", i, got[i].Addr, want[i].Addr)
+				}
+			}
+		})
+	}
+}
+
+func TestIterativeLookupQueryCap(t *testing.T) {
+	useLookupTables(t, "10.0.0.1:6881")
+	var target NodeID
+
+	// Every reply holds nodes closer to the target than any before, so the
+	// lookup never converges and only the cap ends it
+	var mu sync.Mutex
+	queries, distance := 0, uint32(1<<31)
+	query := func(address string) ([]Node, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries++
+		var nodes []Node
+		for i := 0; i < lookupK; i++ {
+			distance--
+			var id NodeID
+			id[16], id[17], id[18], id[19] = byte(distance>>24), byte(distance>>16), byte(distance>>8), byte(distance)
+			nodes = append(nodes, Node{ID: id, Addr: fmt.Sprintf("10.1.%d.%d:6881", distance>>8&0xff, distance&0xff)})
+		}
+		return nodes, nil
+	}
+	handle := func(address string, nodes []Node) (string, []Node, bool) {
+		return "", nodes, false
+	}
+
+	got := iterativeLookup(target, query, handle)
+	if queries != maxLookupQueries {
+		t.Errorf("%d queries, want the cap of %d", queries, maxLookupQueries)
+	}
+	if len(got) != lookupK {
+		t.Errorf("got %d nodes, want %d", len(got), lookupK)
+	}
+}
+
+func TestIterativeLookupBootstrapFallback(t *testing.T) {
+	const bootstrap = "10.9.9.9:6881"
+	var target NodeID
+	tableNodes := func(n int) []Node {
+		var nodes []Node
+		for i := 0; i < n; i++ {
+			// One node per bucket of the table, whose own ID starts with 0xff
+			var id NodeID
+			id[0] = 0xff ^ (0x80 >> i)
+			nodes = append(nodes, Node{ID: id, Addr: fmt.Sprintf("10.0.0.%d:6881", i+1)})
+		}
+		return nodes
+	}
+	failAll := func(address string) ([]Node, error) { return nil, errors.New("timed out") }
+	handle := func(string, []Node) (string, []Node, bool) { return "", nil, false }
+
+	t.Run("full table", func(t *testing.T) {
+		useLookupTables(t, bootstrap, tableNodes(lookupK)...)
+		var mu sync.Mutex
+		queried := make(map[string]bool)
+		iterativeLookup(target, func(address string) ([]Node, error) {
+			mu.Lock()
+			queried[address] = true
+			mu.Unlock()
+			return failAll(address)
+		}, handle)
+		if len(queried) != lookupK || queried[bootstrap] {
+			t.Errorf("queried %v, want only the %d table nodes", queried, lookupK)
+		}
+	})
+
+	t.Run("sparse table", func(t *testing.T) {
+		useLookupTables(t, bootstrap, tableNodes(lookupAlpha)...)
+		entered := make(chan string, lookupAlpha+1)
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			iterativeLookup(target, func(address string) ([]Node, error) {
+				entered <- address
+				<-release
+				return failAll(address)
+			}, handle)
+			close(done)
+		}()
+
+		// The bootstrap node has the farthest ID, so the table nodes are
+		// queried first
+		for i := 0; i < lookupAlpha; i++ {
+			if address := <-entered; address == bootstrap {
+				t.Errorf("bootstrap node queried before the table nodes")
+			}
+		}
+		close(release)
+		<-done
+		if address := <-entered; address != bootstrap {
+			t.Errorf("last query to %s, want the bootstrap node", address)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Harvest configuration
+const (
+	harvestWorkers      = 20
+	harvestQueueSize    = 10000
+	harvestDedupeWindow = 10 * time.Minute
+)
+
+// harvestSource identifies where an infohash was discovered
+type harvestSource int
+
+const (
+	sourceSampleInfohashes harvestSource = iota
+	sourceGetPeers
+	sourceAnnouncePeer
+)
+
+// harvestedInfohash is an infohash learned from DHT traffic. Peer is only
+// set for announce_peer, where the announcing node is known to have it, and
+// lookup is set when the infohash is new and needs a get_peers lookup.
+type harvestedInfohash struct {
+	infohash string
+	peer     string
+	lookup   bool
+}
+
+// HarvestStats counts the new infohashes discovered from each source
+type HarvestStats struct {
+	SampleInfohashes uint64
+	GetPeers         uint64
+	AnnouncePeer     uint64
+	Dropped          uint64 // Discarded because the harvest queue was full
+}
+
+var (
+	harvestQueue    = make(chan harvestedInfohash, harvestQueueSize)
+	harvestCounters [3]uint64
+	harvestDropped  uint64
+	recentHarvests  sync.Map
+)
+
+// GetHarvestStats returns a snapshot of the harvest counters
+func GetHarvestStats() HarvestStats {
+	return HarvestStats{
+		SampleInfohashes: atomic.LoadUint64(&harvestCounters[sourceSampleInfohashes]),
+		GetPeers:         atomic.LoadUint64(&harvestCounters[sourceGetPeers]),
+		AnnouncePeer:     atomic.LoadUint64(&harvestCounters[sourceAnnouncePeer]),
+		Dropped:          atomic.LoadUint64(&harvestDropped),
+	}
+}
+
+// isNewHarvest reports whether an infohash is worth processing: not seen
+// within harvestDedupeWindow and not already stored.
+func isNewHarvest(infohash string) bool {
+	now := time.Now()
+	if value, loaded := recentHarvests.LoadOrStore(infohash, now); loaded {
+		if now.Sub(value.(time.Time)) < harvestDedupeWindow {
+			return false
+		}
+		recentHarvests.Store(infohash, now)
+	}
+	return db == nil || !CheckInfohashExists(infohash)
+}
+
+// harvest queues a discovered infohash for processing, reporting whether
+// it was new. New infohashes are counted against source only once queued;
+// one dropped because the queue is full is forgotten again, so that the
+// next sighting can queue it.
+func harvest(infohash, peer string, source harvestSource) bool {
+	swarms.seen(infohash)
+	if peer != "" {
+		swarms.addPeers(infohash, peer)
+	}
+	isNew := isNewHarvest(infohash)
+	// An announce still hands us a peer worth trying even if the infohash
+	// is already being looked up
+	if !isNew && peer == "" {
+		return false
+	}
+	select {
+	case harvestQueue <- harvestedInfohash{infohash: infohash, peer: peer, lookup: isNew}:
+		if isNew {
+			atomic.AddUint64(&harvestCounters[source], 1)
+		}
+		return isNew
+	default:
+		atomic.AddUint64(&harvestDropped, 1)
+		if isNew {
+			recentHarvests.Delete(infohash)
+		}
+		return false
+	}
+}
+
+// processHarvested drains the harvest queue until ctx is cancelled. New
+// infohashes go through a get_peers lookup, with any announced peer tried
+// while it runs; announced peers of infohashes already being looked up are
+// handed to the fetch in flight.
+func processHarvested(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < harvestWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case h := <-harvestQueue:
+					if CheckInfohashExists(h.infohash) {
+						continue
+					}
+					if h.lookup && h.peer != "" {
+						lookupAndFetch(ctx, h.infohash, h.peer)
+					} else if h.lookup {
+						lookupAndFetch(ctx, h.infohash)
+					} else {
+						FetchMetadata(ctx, h.infohash, h.peer)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Forget old entries in the dedupe set
+	ticker := time.NewTicker(harvestDedupeWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			recentHarvests.Range(func(key, value interface{}) bool {
+				if now.Sub(value.(time.Time)) > harvestDedupeWindow {
+					recentHarvests.Delete(key)
+				}
+				return true
+			})
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+	}
+}
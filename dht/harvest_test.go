@@ -0,0 +1,37 @@
+package dht
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHarvestQueueFull(t *testing.T) {
+	saved := harvestQueue
+	defer func() { harvestQueue = saved }()
+	infohash := strings.Repeat("ab", 20)
+	defer recentHarvests.Delete(infohash)
+	counted := atomic.LoadUint64(&harvestCounters[sourceGetPeers])
+
+	harvestQueue = make(chan harvestedInfohash)
+	if harvest(infohash, "", sourceGetPeers) {
+		t.Error("harvest reported a dropped infohash as new")
+	}
+	if n := atomic.LoadUint64(&harvestCounters[sourceGetPeers]); n != counted {
+		t.Errorf("dropped infohash counted: %d, want %d", n, counted)
+	}
+
+	harvestQueue = make(chan harvestedInfohash, 1)
+	if !harvest(infohash, "", sourceGetPeers) {
+		t.Fatal("infohash dropped from a full queue was deduplicated")
+	}
+	if n := atomic.LoadUint64(&harvestCounters[sourceGetPeers]); n != counted+1 {
+		t.Errorf("queued infohash counted: %d, want %d", n, counted+1)
+	}
+	if h := <-harvestQueue; h.infohash != infohash || !h.lookup {
+		t.Errorf("queued %+v", h)
+	}
+	if harvest(infohash, "", sourceGetPeers) {
+		t.Error("queued infohash not deduplicated")
+	}
+}
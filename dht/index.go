@@ -51,6 +51,11 @@ func (ts *TokenScorer) tokenize(text string) []string {
     return tokens
 }
 
+// IndexTorrent indexes a decoded torrent by its name and file paths
+func IndexTorrent(t *Torrent) error {
+    return Index(t.Infohash, t.Name, t.FilePaths())
+}
+
 // Index indexes a torrent with improved performance and memory usage
 func Index(infohash, name string, files []string) error {
     if infohash == "" {
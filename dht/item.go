@@ -0,0 +1,353 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// BEP 44 limits
+const (
+	maxItemValueSize = 1000 // Bytes in a bencoded value
+	maxItemSaltSize  = 64
+)
+
+// Item is a BEP 44 item. Value holds the raw bencoded value, which can be
+// decoded with bencode.Decode or bencode.Unmarshal.
+type Item struct {
+	Target    string // Hex SHA-1 of the value, or of the public key and salt
+	Value     []byte
+	PublicKey ed25519.PublicKey // Nil for immutable items
+	Salt      []byte
+	Seq       int64
+	Signature []byte
+}
+
+// Mutable reports whether the item is a signed, mutable item
+func (i *Item) Mutable() bool {
+	return i.PublicKey != nil
+}
+
+// GetReq is a BEP 44 get query
+type GetReq struct {
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+	Q string `bencode:"q"`
+	A struct {
+		ID     string   `bencode:"id"`
+		Target string   `bencode:"target"`
+		Want   []string `bencode:"want,omitempty"`
+	} `bencode:"a"`
+}
+
+func (r *GetReq) setTransactionID(t string) { r.T = t }
+
+// GetResp is the response to a get query. Its "v" may be of any type and is
+// read from the raw packet instead.
+type GetResp struct {
+	R struct {
+		ID     string `bencode:"id"`
+		Token  string `bencode:"token"`
+		Nodes  string `bencode:"nodes,omitempty"`
+		Nodes6 string `bencode:"nodes6,omitempty"`
+		K      string `bencode:"k,omitempty"`   // Public key of a mutable item
+		Seq    int64  `bencode:"seq,omitempty"` // Sequence number of a mutable item
+		Sig    string `bencode:"sig,omitempty"` // Signature of a mutable item
+	} `bencode:"r"`
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+}
+
+// PutReq is a BEP 44 put query. The arguments are a map because "seq" and
+// "cas" must be sent even when zero, which omitempty cannot express.
+type PutReq struct {
+	T string                 `bencode:"t"`
+	Y string                 `bencode:"y"`
+	Q string                 `bencode:"q"`
+	A map[string]interface{} `bencode:"a"`
+}
+
+func (r *PutReq) setTransactionID(t string) { r.T = t }
+
+// itemReply is a get response with its raw value
+type itemReply struct {
+	resp  GetResp
+	value []byte // Nil if the node has no item
+}
+
+// ImmutableTarget returns the hex target an immutable value is stored under
+func ImmutableTarget(value interface{}) (string, error) {
+	encoded, err := encodeItemValue(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// MutableTarget returns the hex target of the mutable items signed with
+// publicKey under salt
+func MutableTarget(publicKey ed25519.PublicKey, salt []byte) string {
+	sum := sha1.Sum(append(append([]byte(nil), publicKey...), salt...))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeItemValue bencodes a value and checks it fits in an item
+func encodeItemValue(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, value); err != nil {
+		return nil, fmt.Errorf("failed to encode value: %v", err)
+	}
+	if buf.Len() > maxItemValueSize {
+		return nil, fmt.Errorf("value is %d bytes, the limit is %d", buf.Len(), maxItemValueSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// signedItemData is the data a mutable item's signature covers
+func signedItemData(salt []byte, seq int64, value []byte) []byte {
+	var buf bytes.Buffer
+	if len(salt) > 0 {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// verify checks that a value returned for target is genuine: the value of
+// an immutable item must hash to the target, and a mutable item must be
+// signed by the key the target was derived from.
+func (r *itemReply) verify(target NodeID, salt []byte) (*Item, bool) {
+	if r.value == nil || len(r.value) > maxItemValueSize {
+		return nil, false
+	}
+	item := &Item{Target: target.String(), Value: r.value}
+	if r.resp.R.K == "" {
+		return item, sha1.Sum(r.value) == target
+	}
+
+	publicKey := ed25519.PublicKey(r.resp.R.K)
+	if len(publicKey) != ed25519.PublicKeySize || MutableTarget(publicKey, salt) != item.Target {
+		return nil, false
+	}
+	signature := []byte(r.resp.R.Sig)
+	if !ed25519.Verify(publicKey, signedItemData(salt, r.resp.R.Seq, r.value), signature) {
+		return nil, false
+	}
+	item.PublicKey = publicKey
+	item.Salt = salt
+	item.Seq = r.resp.R.Seq
+	item.Signature = signature
+	return item, true
+}
+
+// getItem sends a get query for target (raw 20 bytes) to a node
+func getItem(address, target string) (*itemReply, error) {
+	t, err := getTransport()
+	if err != nil {
+		return nil, err
+	}
+	req := GetReq{Y: "q", Q: "get"}
+	req.A.ID = localID().raw()
+	req.A.Target = target
+	req.A.Want = t.want()
+
+	packet, err := t.query(address, &req, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	reply := &itemReply{}
+	if err := decodeBencode(packet, &reply.resp); err != nil {
+		autoBanAddr(address)
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	r, err := bencodeDictValue(packet, "r")
+	if err != nil || r == nil {
+		autoBanAddr(address)
+		return nil, fmt.Errorf("invalid get response")
+	}
+	if reply.value, err = bencodeDictValue(r, "v"); err != nil {
+		autoBanAddr(address)
+		return nil, fmt.Errorf("invalid get response: %v", err)
+	}
+	return reply, nil
+}
+
+// lookupItem walks the DHT towards target collecting put tokens. With
+// find set it also looks for the item: an immutable item ends the lookup
+// once found, while for mutable items the highest sequence number wins.
+func lookupItem(target NodeID, salt []byte, find bool) (*Item, []Node, map[string]string) {
+	var found *Item
+	tokens := make(map[string]string)
+	query := func(address string) (*itemReply, error) {
+		return getItem(address, target.raw())
+	}
+	handle := func(address string, reply *itemReply) (string, []Node, bool) {
+		if reply.resp.R.Token != "" {
+			tokens[address] = reply.resp.R.Token
+		}
+		nodes := append(parseCompactNodes(reply.resp.R.Nodes), parseCompactNodes6(reply.resp.R.Nodes6)...)
+		if !find {
+			return reply.resp.R.ID, nodes, false
+		}
+		item, ok := reply.verify(target, salt)
+		if ok && (found == nil || item.Seq > found.Seq) {
+			found = item
+		}
+		return reply.resp.R.ID, nodes, found != nil && !found.Mutable()
+	}
+	closest := iterativeLookup(target, query, handle)
+	return found, closest, tokens
+}
+
+// GetImmutable fetches the immutable item stored under target (hex)
+func GetImmutable(target string) (*Item, error) {
+	id, err := parseItemTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	item, _, _ := lookupItem(id, nil, true)
+	if item == nil || item.Mutable() {
+		return nil, fmt.Errorf("no item found for %s", target)
+	}
+	return item, nil
+}
+
+// GetMutable fetches the mutable item with the highest sequence number
+// signed with publicKey under salt
+func GetMutable(publicKey ed25519.PublicKey, salt []byte) (*Item, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length: %d", len(publicKey))
+	}
+	target := MutableTarget(publicKey, salt)
+	id, _ := parseItemTarget(target)
+	item, _, _ := lookupItem(id, salt, true)
+	if item == nil || !item.Mutable() {
+		return nil, fmt.Errorf("no item found for %s", target)
+	}
+	return item, nil
+}
+
+// PutImmutable stores value, anything bencode can marshal, as an immutable
+// item. It returns the item and the number of nodes that accepted it.
+func PutImmutable(value interface{}) (*Item, int, error) {
+	encoded, err := encodeItemValue(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	sum := sha1.Sum(encoded)
+	item := &Item{Target: hex.EncodeToString(sum[:]), Value: encoded}
+	stored, err := putItem(NodeID(sum), map[string]interface{}{"v": value})
+	return item, stored, err
+}
+
+// PutMutable signs value, anything bencode can marshal, with key and stores
+// it under the target of the public key and salt with sequence number seq.
+// If cas is not nil, nodes only accept the put if the item they hold has
+// sequence number *cas. It returns the item and the number of nodes that
+// accepted it; if none did, a rejection is returned as a *KRPCError with
+// code KRPCCASMismatch or KRPCSeqTooLow.
+func PutMutable(key ed25519.PrivateKey, salt []byte, seq int64, value interface{}, cas *int64) (*Item, int, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, 0, fmt.Errorf("invalid private key length: %d", len(key))
+	}
+	if len(salt) > maxItemSaltSize {
+		return nil, 0, fmt.Errorf("salt is %d bytes, the limit is %d", len(salt), maxItemSaltSize)
+	}
+	encoded, err := encodeItemValue(value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	publicKey := key.Public().(ed25519.PublicKey)
+	item := &Item{
+		Target:    MutableTarget(publicKey, salt),
+		Value:     encoded,
+		PublicKey: publicKey,
+		Salt:      salt,
+		Seq:       seq,
+		Signature: ed25519.Sign(key, signedItemData(salt, seq, encoded)),
+	}
+	args := map[string]interface{}{
+		"v":   value,
+		"k":   string(publicKey),
+		"seq": seq,
+		"sig": string(item.Signature),
+	}
+	if len(salt) > 0 {
+		args["salt"] = string(salt)
+	}
+	if cas != nil {
+		args["cas"] = *cas
+	}
+	id, _ := parseItemTarget(item.Target)
+	stored, err := putItem(id, args)
+	return item, stored, err
+}
+
+// putItem looks up the nodes closest to target and sends them a put with
+// args, returning how many accepted it
+func putItem(target NodeID, args map[string]interface{}) (int, error) {
+	t, err := getTransport()
+	if err != nil {
+		return 0, err
+	}
+	_, closest, tokens := lookupItem(target, nil, false)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stored  int
+		lastErr error
+	)
+	for _, node := range closest {
+		token, ok := tokens[node.Addr]
+		if !ok {
+			continue
+		}
+		req := PutReq{Y: "q", Q: "put", A: map[string]interface{}{"id": localID().raw(), "token": token}}
+		for key, value := range args {
+			req.A[key] = value
+		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			_, err := t.query(address, &req, requestTimeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			stored++
+		}(node.Addr)
+	}
+	wg.Wait()
+
+	if stored == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no nodes to store the item on")
+		}
+		return 0, fmt.Errorf("put failed: %w", lastErr)
+	}
+	return stored, nil
+}
+
+// parseItemTarget decodes a hex target
+func parseItemTarget(target string) (NodeID, error) {
+	raw, err := hex.DecodeString(target)
+	if err != nil {
+		return NodeID{}, fmt.Errorf("invalid target: %v", err)
+	}
+	id, ok := nodeIDFromString(string(raw))
+	if !ok {
+		return NodeID{}, fmt.Errorf("invalid target length: %d", len(raw))
+	}
+	return id, nil
+}
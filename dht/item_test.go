@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+// The mutable item test vectors of BEP 44
+const (
+	bep44PublicKey = "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"
+	bep44Value     = "12:Hello World!"
+)
+
+func TestMutableItemVectors(t *testing.T) {
+	tests := []struct {
+		salt      string
+		data      string
+		target    string
+		signature string
+	}{
+		{
+			data:      "3:seqi1e1:v12:Hello World!",
+			target:    "4a533d47ec9c7d95b1ad75f576cffc641853b750",
+			signature: "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+		},
+		{
+			salt:      "foobar",
+			data:      "4:salt6:foobar3:seqi1e1:v12:Hello World!",
+			target:    "411eba73b6f087ca51a3795d9c8c938d365e32c1",
+			signature: "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+		},
+	}
+	publicKey, _ := hex.DecodeString(bep44PublicKey)
+	for _, tt := range tests {
+		salt := []byte(tt.salt)
+		if data := signedItemData(salt, 1, []byte(bep44Value)); string(data) != tt.data {
+			t.Errorf("signedItemData(%q) = %q, want %q", tt.salt, data, tt.data)
+		}
+		if target := MutableTarget(publicKey, salt); target != tt.target {
+			t.Errorf("MutableTarget(%q) = %s, want %s", tt.salt, target, tt.target)
+		}
+		signature, _ := hex.DecodeString(tt.signature)
+		if !ed25519.Verify(publicKey, []byte(tt.data), signature) {
+			t.Errorf("signature over %q does not verify", tt.data)
+		}
+
+		reply := func(seq int64, value string) *itemReply {
+			r := &itemReply{value: []byte(value)}
+			r.resp.R.K = string(publicKey)
+			r.resp.R.Seq = seq
+			r.resp.R.Sig = string(signature)
+			return r
+		}
+		rawTarget, _ := hex.DecodeString(tt.target)
+		target, _ := nodeIDFromString(string(rawTarget))
+		item, ok := reply(1, bep44Value).verify(target, salt)
+		if !ok {
+			t.Fatalf("verify rejected the vector with salt %q", tt.salt)
+		}
+		if !item.Mutable() || item.Seq != 1 || item.Target != tt.target || string(item.Value) != bep44Value {
+			t.Errorf("verified item = %+v", item)
+		}
+		if _, ok := reply(2, bep44Value).verify(target, salt); ok {
+			t.Errorf("verify accepted a tampered seq with salt %q", tt.salt)
+		}
+		if _, ok := reply(1, "12:Hello World?").verify(target, salt); ok {
+			t.Errorf("verify accepted a tampered value with salt %q", tt.salt)
+		}
+		if _, ok := reply(1, bep44Value).verify(target, []byte("other")); ok {
+			t.Errorf("verify accepted the wrong salt for %q", tt.salt)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC transport configuration
+const (
+	krpcPort            = 6881
+	transactionIDLength = 4
+	maxPacketSize       = 65535
+)
+
+// KRPC error codes (BEP 5, BEP 44), the Code of a KRPCError
+const (
+	KRPCGenericError     = 201
+	KRPCServerError      = 202
+	KRPCProtocolError    = 203
+	KRPCMethodUnknown    = 204
+	KRPCMessageTooBig    = 205
+	KRPCInvalidSignature = 206
+	KRPCSaltTooBig       = 207
+	KRPCCASMismatch      = 301
+	KRPCSeqTooLow        = 302
+)
+
+// KRPCError is an error reply ("y" = "e") from a node
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+// isKRPCError reports whether err is, or wraps, a KRPC error with code
+func isKRPCError(err error, code int) bool {
+	var krpcErr *KRPCError
+	return errors.As(err, &krpcErr) && krpcErr.Code == code
+}
+
+// parseKRPCError decodes the [code, message] list of an error reply
+func parseKRPCError(packet []byte) *KRPCError {
+	krpcErr := &KRPCError{Code: KRPCGenericError, Message: "malformed error reply"}
+	value, _ := decodeBencodeValue(packet)
+	msg, _ := value.(map[string]interface{})
+	e, _ := msg["e"].([]interface{})
+	if len(e) > 0 {
+		if code, ok := e[0].(int64); ok {
+			krpcErr.Code = int(code)
+		}
+	}
+	if len(e) > 1 {
+		if message, ok := e[1].(string); ok {
+			krpcErr.Message = message
+		}
+	}
+	return krpcErr
+}
+
+// krpcHeader holds the fields common to every KRPC message, used to route a
+// packet before it is decoded into its concrete type.
+type krpcHeader struct {
+	IP string `bencode:"ip"`
+	T  string `bencode:"t"`
+	Y  string `bencode:"y"`
+	Q  string `bencode:"q"`
+	R  struct {
+		ID string `bencode:"id"`
+	} `bencode:"r"`
+}
+
+// krpcRequest is implemented by every outgoing query so the transport can
+// stamp it with a fresh transaction ID.
+type krpcRequest interface {
+	setTransactionID(t string)
+}
+
+// pendingQuery is a query waiting for its response
+type pendingQuery struct {
+	ip   net.IP
+	resp chan []byte
+}
+
+// krpcTransport multiplexes all DHT queries over a single UDP port, with an
+// IPv4 socket and, when EnableIPv6 is set, an IPv6 socket on the same port.
+type krpcTransport struct {
+	conn    *net.UDPConn
+	conn6   *net.UDPConn
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	done    chan struct{}
+}
+
+var (
+	transport     *krpcTransport
+	transportLock sync.Mutex
+)
+
+// EnableIPv6 makes the KRPC transport bind a second, IPv6 socket on the same
+// port so that the crawler takes part in the IPv6 DHT (BEP 32). It must be
+// set before the transport is started.
+var EnableIPv6 = true
+
+// StartKRPC binds the shared KRPC socket on the given port. It is called
+// lazily with krpcPort by the first query if the caller never starts it.
+func StartKRPC(port int) error {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport != nil {
+		return nil
+	}
+	t, err := newKRPCTransport(port)
+	if err != nil {
+		return err
+	}
+	transport = t
+	return nil
+}
+
+// CloseKRPC closes the shared KRPC socket
+func CloseKRPC() {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport != nil {
+		transport.close()
+		transport = nil
+	}
+}
+
+// getTransport returns the shared transport, binding it on first use. If the
+// default port is taken an ephemeral port is used instead.
+func getTransport() (*krpcTransport, error) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport != nil {
+		return transport, nil
+	}
+	t, err := newKRPCTransport(krpcPort)
+	if err != nil {
+		t, err = newKRPCTransport(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport = t
+	return transport, nil
+}
+
+func newKRPCTransport(port int) (*krpcTransport, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind KRPC socket: %v", err)
+	}
+	t := &krpcTransport{
+		conn:    conn,
+		pending: make(map[string]*pendingQuery),
+		done:    make(chan struct{}),
+	}
+	go t.readLoop(conn)
+
+	// IPv6 is best effort: hosts without a v6 stack keep working over v4
+	if EnableIPv6 {
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: port})
+		if err == nil {
+			t.conn6 = conn6
+			go t.readLoop(conn6)
+		}
+	}
+	return t, nil
+}
+
+func (t *krpcTransport) close() {
+	close(t.done)
+	t.conn.Close()
+	if t.conn6 != nil {
+		t.conn6.Close()
+	}
+}
+
+// connFor returns the socket for addr's address family
+func (t *krpcTransport) connFor(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if addr.IP.To4() != nil {
+		return t.conn, nil
+	}
+	if t.conn6 == nil {
+		return nil, fmt.Errorf("IPv6 is not enabled")
+	}
+	return t.conn6, nil
+}
+
+// supportsIPv6 reports whether the transport has an IPv6 socket
+func (t *krpcTransport) supportsIPv6() bool {
+	return t.conn6 != nil
+}
+
+// want returns the BEP 32 "want" list for our outgoing queries
+func (t *krpcTransport) want() []string {
+	if t.supportsIPv6() {
+		return []string{"n4", "n6"}
+	}
+	return nil
+}
+
+// newTransactionID reserves a random transaction ID that is not in flight
+func (t *krpcTransport) newTransactionID(p *pendingQuery) (string, error) {
+	buf := make([]byte, transactionIDLength)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to generate transaction ID: %v", err)
+		}
+		tid := string(buf)
+		if _, ok := t.pending[tid]; !ok {
+			t.pending[tid] = p
+			return tid, nil
+		}
+	}
+}
+
+func (t *krpcTransport) release(tid string) {
+	t.mu.Lock()
+	delete(t.pending, tid)
+	t.mu.Unlock()
+}
+
+// query sends req to address and waits up to timeout for the matching
+// response, which is returned undecoded. Error replies are returned as a
+// *KRPCError.
+func (t *krpcTransport) query(address string, req krpcRequest, timeout time.Duration) ([]byte, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", address, err)
+	}
+	if blockedIP(addr.IP) {
+		return nil, fmt.Errorf("query to %s not sent: %w", address, errBlocked)
+	}
+
+	p := &pendingQuery{ip: addr.IP, resp: make(chan []byte, 1)}
+	tid, err := t.newTransactionID(p)
+	if err != nil {
+		return nil, err
+	}
+	defer t.release(tid)
+	req.setTransactionID(tid)
+
+	// Wait for our share of the global and per-IP query budgets, unless the
+	// node has stopped answering or the wait would outlast the timeout
+	data, err := encodeMessage(req)
+	if err != nil {
+		return nil, err
+	}
+	wait, err := limiter.reserveQuery(addr.IP, len(data), timeout)
+	if err != nil {
+		// A query skipped for backoff counts as unanswered, so that a dead
+		// node still turns bad and can be evicted from its bucket
+		if errors.Is(err, errBackoff) {
+			tableFor(addr.IP).MarkFailure(addr.String())
+		}
+		return nil, fmt.Errorf("query to %s not sent: %w", address, err)
+	}
+	if wait > 0 {
+		delay := time.NewTimer(wait)
+		select {
+		case <-delay.C:
+		case <-t.done:
+			delay.Stop()
+			return nil, fmt.Errorf("transport closed")
+		}
+	}
+	if err := t.write(addr, data); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-p.resp:
+		limiter.answered(addr.IP)
+		var header krpcHeader
+		decodeBencode(resp, &header)
+		if header.Y == "e" {
+			return nil, parseKRPCError(resp)
+		}
+		// Every response carries the 20-byte ID of the node sending it
+		if _, ok := nodeIDFromString(header.R.ID); !ok {
+			blocklist.ban(addr.IP)
+			return nil, fmt.Errorf("malformed response from %s", address)
+		}
+		return resp, nil
+	case <-timer.C:
+		tableFor(addr.IP).MarkFailure(addr.String())
+		limiter.unanswered(addr.IP)
+		return nil, fmt.Errorf("request to %s timed out", address)
+	case <-t.done:
+		return nil, fmt.Errorf("transport closed")
+	}
+}
+
+// send marshals a reply and writes it to addr. Replies that do not fit in
+// the outbound byte budget are dropped.
+func (t *krpcTransport) send(addr *net.UDPAddr, msg interface{}) error {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	if !limiter.allowReply(len(data)) {
+		return fmt.Errorf("reply to %s dropped by rate limit", addr)
+	}
+	return t.write(addr, data)
+}
+
+// write sends an encoded message to addr
+func (t *krpcTransport) write(addr *net.UDPAddr, data []byte) error {
+	conn, err := t.connFor(addr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(data, addr)
+	return err
+}
+
+// encodeMessage marshals a KRPC message. bencode cannot encode pointers, so
+// messages are marshalled by value.
+func encodeMessage(msg interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, reflect.Indirect(reflect.ValueOf(msg)).Interface()); err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readLoop reads packets off the socket, answers incoming queries, hands
+// responses to the query waiting on their transaction ID and passes uTP
+// packets on to their connection.
+func (t *krpcTransport) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+				continue
+			}
+		}
+		if blockedIP(from.IP) {
+			continue
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		// KRPC messages are bencoded dictionaries; anything else sharing
+		// the socket is uTP
+		if n > 0 && packet[0] != 'd' {
+			handleUTPPacket(from, packet)
+			continue
+		}
+
+		var header krpcHeader
+		if err := decodeBencode(packet, &header); err != nil {
+			continue
+		}
+		switch header.Y {
+		case "q":
+			go t.handleQuery(from, packet)
+		case "r", "e":
+			if t.deliver(header.T, from, packet) && header.Y == "r" {
+				// Every node that answers one of our queries is a
+				// candidate for the routing table
+				if id, ok := nodeIDFromString(header.R.ID); ok {
+					tableFor(from.IP).Insert(id, from.String())
+				}
+				observeExternalIP(header.IP, from.IP)
+			}
+		}
+	}
+}
+
+// deliver hands packet to the query waiting on tid, reporting whether one
+// was found. A response to a query in flight that comes from another IP
+// is spoofed, and its sender is banned.
+func (t *krpcTransport) deliver(tid string, from *net.UDPAddr, packet []byte) bool {
+	t.mu.Lock()
+	p, ok := t.pending[tid]
+	spoofed := ok && !p.ip.Equal(from.IP)
+	if ok && !spoofed {
+		delete(t.pending, tid)
+	}
+	t.mu.Unlock()
+	if spoofed {
+		blocklist.ban(from.IP)
+		return false
+	}
+	if ok {
+		p.resp <- packet
+	}
+	return ok
+}
+
+// decodeBencode unmarshals untrusted data into v. The bencode package panics
+// on some type mismatches, so the panic is turned into an error here.
+func decodeBencode(data []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed bencode: %v", r)
+		}
+	}()
+	return bencode.Unmarshal(bytes.NewReader(data), v)
+}
@@ -2,19 +2,27 @@ package dht
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	// "log"
 	"net"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/boltdb/bolt"
 	"github.com/jackpal/bencode-go"
 )
 
 const (
-	dbPath = "./torrent.db"
+	dbPath            = "./torrent.db"
+	metadataPieceSize = 16384
+	maxMetadataSize   = 8 << 20          // Larger info dictionaries are refused
+	metadataPipeline  = 8                // Piece requests kept outstanding per peer
+	metadataTimeout   = 60 * time.Second // Overall deadline for fetching from one peer
+	peerBanDuration   = 6 * time.Hour    // How long a peer that served bad metadata is skipped
 )
 
 var (
@@ -22,14 +30,15 @@ var (
     dbLock sync.Mutex // Mutex to handle concurrent access to the database
 )
 
-// Open BoltDB once and assign it to the global db variable
+// Open BoltDB once and assign it to the global db variable, then restore
+// our node identity from it
 func InitDB() error {
     var err error
     db, err = bolt.Open(dbPath, 0666, nil)
     if err != nil {
         return fmt.Errorf("failed to open BoltDB: %v", err)
     }
-    return nil
+    return loadNodeIdentity()
 }
 
 // Close the database connection
@@ -52,8 +61,10 @@ func CloseDB() {
 // 	return db, nil
 // }
 
-// Save infohash and metadata to BoltDB
-func saveMetadataToBoltDB(db *bolt.DB, infohash string, metadata []byte) error {
+// Save infohash and metadata to BoltDB, recording the other infohashes of
+// v2 and hybrid torrents as aliases of it and folding their swarm records
+// into its own
+func saveMetadataToBoltDB(db *bolt.DB, infohash string, metadata []byte, aliases ...string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		// Create or get the "Metadata" bucket
 		bucket, err := tx.CreateBucketIfNotExists([]byte("Metadata"))
@@ -61,266 +72,393 @@ func saveMetadataToBoltDB(db *bolt.DB, infohash string, metadata []byte) error {
 			return fmt.Errorf("failed to create bucket: %v", err)
 		}
 		// Store the metadata with the infohash as the key
-		return bucket.Put([]byte(infohash), metadata)
+		if err := bucket.Put([]byte(infohash), metadata); err != nil {
+			return err
+		}
+		for _, alias := range aliases {
+			if alias == infohash {
+				continue
+			}
+			aliasBucket, err := tx.CreateBucketIfNotExists([]byte(aliasBucketName))
+			if err != nil {
+				return fmt.Errorf("failed to create bucket: %v", err)
+			}
+			if err := aliasBucket.Put([]byte(alias), []byte(infohash)); err != nil {
+				return err
+			}
+		}
+		return mergeSwarmAliases(tx, infohash, aliases)
 	})
 }
 
-func Metadata(peerIP, infohash string) {
-	conn, err := net.DialTimeout("tcp", peerIP, connectionTimeout)
-	if err != nil {
-		// log.Printf("Failed to connect to peer: %v", err)
-		return
-	}
-	defer conn.Close()
+// ut_metadata message types (BEP 9)
+const (
+	utMetadataRequest = 0
+	utMetadataData    = 1
+	utMetadataReject  = 2
+)
+
+// MetadataMessage is the dictionary at the start of a ut_metadata message.
+// Data messages carry the piece after it.
+type MetadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// badPeerTracker counts the peers that served metadata not matching the
+// requested infohash and bans them from further fetches of that infohash
+type badPeerTracker struct {
+	mu         sync.Mutex
+	mismatches map[string]int       // Mismatches per peer IP
+	banned     map[string]time.Time // Ban expiry keyed by peer IP + infohash
+}
+
+var badPeers = &badPeerTracker{
+	mismatches: make(map[string]int),
+	banned:     make(map[string]time.Time),
+}
 
-	err = sendStandardHandshake(conn, infohash)
+// peerHost returns the IP of a peer address, so that a peer cannot escape a
+// ban by reconnecting from another port
+func peerHost(peer string) string {
+	host, _, err := net.SplitHostPort(peer)
 	if err != nil {
-		// log.Printf("Failed to send handshake: %v", err)
-		return
+		return peer
 	}
+	return host
+}
 
-	if err = receivePeerHandshake(conn); err != nil {
-		// log.Printf("Failed to receive peer handshake: %v", err)
-		return
+// ban records a mismatch from peer and bans it for infohash
+func (b *badPeerTracker) ban(peer, infohash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for key, expiry := range b.banned {
+		if now.After(expiry) {
+			delete(b.banned, key)
+		}
 	}
+	b.mismatches[peerHost(peer)]++
+	b.banned[peerHost(peer)+"/"+infohash] = now.Add(peerBanDuration)
+}
 
-	err = sendExtensionHandshake(conn)
-	if err != nil {
-		// log.Printf("Failed to send extension handshake: %v", err)
-		return
-	}
+// isBanned reports whether peer is banned for infohash
+func (b *badPeerTracker) isBanned(peer, infohash string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expiry, ok := b.banned[peerHost(peer)+"/"+infohash]
+	return ok && time.Now().Before(expiry)
+}
 
-	utMetadataID, metadataSize, err := receiveExtensionHandshakeResponse(conn)
-	if err != nil {
-		// log.Printf("Failed to receive extension handshake response: %v", err)
-		return
+// GetMetadataMismatches returns the number of times each peer IP served
+// metadata that did not match the requested infohash
+func GetMetadataMismatches() map[string]int {
+	badPeers.mu.Lock()
+	defer badPeers.mu.Unlock()
+	mismatches := make(map[string]int, len(badPeers.mismatches))
+	for peer, count := range badPeers.mismatches {
+		mismatches[peer] = count
 	}
+	return mismatches
+}
 
-	// fmt.Printf("Peer supports ut_metadata with message ID: %d\n", utMetadataID)
-	// fmt.Printf("Metadata size: %d bytes\n", metadataSize)
+// Fetch the metadata for infohash (hex) from a peer, then store and index it.
+// The fetch goes through the shared fetcher, so it is skipped if the same
+// infohash is already being fetched and joins that fetch instead.
+func Metadata(peerIP, infohash string) error {
+	return FetchMetadata(context.Background(), infohash, peerIP)
+}
+
+// downloadMetadata fetches the info dictionary for infohash (hex) from a
+// peer and checks it against the infohash. Cancelling ctx aborts the
+// download.
+func downloadMetadata(ctx context.Context, peerIP, infohash string) ([]byte, error) {
+	decodedInfohash, err := hex.DecodeString(infohash)
+	if err != nil || len(decodedInfohash) != 20 {
+		return nil, fmt.Errorf("invalid infohash: %s", infohash)
+	}
 
-	if metadataSize==0 {
-		return
+	if blockedAddr(peerIP) {
+		return nil, fmt.Errorf("peer %s is blocklisted", peerIP)
+	}
+	if badPeers.isBanned(peerIP, infohash) {
+		return nil, fmt.Errorf("peer %s is banned for %s", peerIP, infohash)
 	}
 
-	// Retrieve all metadata pieces
-	metadata, err := retrieveMetadata(conn, utMetadataID, metadataSize)
+	// Peers that only speak one of plaintext and MSE drop the handshake
+	// they do not speak, so a failed handshake is retried in the other mode
+	var metadata []byte
+	for _, encrypted := range Encryption.handshakeAttempts() {
+		metadata, err = downloadFromPeer(ctx, peerIP, decodedInfohash, encrypted)
+		if err == nil || !errors.Is(err, errPeerHandshake) || ctx.Err() != nil {
+			break
+		}
+	}
 	if err != nil {
 		// log.Printf("Failed to retrieve metadata: %v", err)
-		return
+		return nil, err
 	}
-	metaNameIndex := bytes.Index(metadata, []byte("4:name"))
-
-	// Check if "4:name" exists in the metadata
-	if metaNameIndex != -1 {
-		// Find the colon after "4:name" to get the length of the name
-		colonIndex := metaNameIndex + len("4:name")
-		nameLengthStart := colonIndex
-		nameLengthEnd := bytes.IndexByte(metadata[nameLengthStart:], ':') + nameLengthStart
-		nameLengthStr := string(metadata[nameLengthStart:nameLengthEnd])
-
-		// Convert the length to an integer
-		nameLength, err := strconv.Atoi(nameLengthStr)
-		if err != nil {
-			// fmt.Println("Error parsing name length:", err)
-			return
-		}
 
-		// Extract the name based on the length
-		nameStart := nameLengthEnd + 1
-		name := string(metadata[nameStart : nameStart+nameLength])
-
-		// fmt.Println("Name extracted:", name)
-		// Open BoltDB
-		// db, err := openBoltDB(dbPath)
-		// if err != nil {
-		// 	log.Printf("Failed to open BoltDB: %v", err)
-		// 	return
-		// }
-		// defer db.Close()
-		err = saveMetadataToBoltDB(db, infohash, metadata)
-		if err != nil {
-			// log.Printf("Failed to save metadata to BoltDB: %v", err)
-		} else {
-			fmt.Printf("Infohash : %s, Name : %s\n",infohash,name)
-			// fmt.Println("Metadata saved to BoltDB successfully")
-			name, files := ParseMetadata(metadata)
-			Index(infohash,name,files)
-		}
-	} else {
-		// fmt.Println("Name field not found in metadata.")
+	// Only the info dictionary hashing to the infohash is genuine
+	if !matchesInfohash(metadata, decodedInfohash) {
+		badPeers.ban(peerIP, infohash)
+		return nil, fmt.Errorf("metadata from %s does not match infohash %s", peerIP, infohash)
 	}
-	// fmt.Println("Metadata retrieved:", string(metadata))
+	return metadata, nil
 }
 
-func sendStandardHandshake(conn net.Conn, infohash string) error {
-	decodedInfohash, err := hex.DecodeString(infohash)
-	if err != nil || len(decodedInfohash) != 20 {
-		return fmt.Errorf("invalid infohash: %w", err)
-	}
-	protocol := "BitTorrent protocol"
-	reserved := make([]byte, 8)
-	reserved[5] |= 0x10
-	peerID := "-DE0001-123456789012"
-
-	buf := new(bytes.Buffer)
-	buf.WriteByte(byte(len(protocol)))
-	buf.WriteString(protocol)
-	buf.Write(reserved)
-	buf.Write(decodedInfohash)
-	buf.WriteString(peerID)
-
-	_, err = conn.Write(buf.Bytes())
-	return err
+// TransportStats counts the peer connections made and the metadata fetched
+// over each transport
+type TransportStats struct {
+	TCPConnections uint64
+	UTPConnections uint64
+	TCPMetadata    uint64
+	UTPMetadata    uint64
 }
 
-func receivePeerHandshake(conn net.Conn) error {
-	peerHandshake := make([]byte, 68)
-	_, err := conn.Read(peerHandshake)
-	if err != nil {
-		return err
-	}
-	if peerHandshake[25]&0x10 == 0 {
-		return fmt.Errorf("peer does not support extension protocol")
+const (
+	transportTCP = iota
+	transportUTP
+)
+
+var (
+	transportNames       = [...]string{transportTCP: "tcp", transportUTP: "utp"}
+	transportConnections [2]uint64
+	transportMetadata    [2]uint64
+)
+
+// GetTransportStats returns a snapshot of the transport counters
+func GetTransportStats() TransportStats {
+	return TransportStats{
+		TCPConnections: atomic.LoadUint64(&transportConnections[transportTCP]),
+		UTPConnections: atomic.LoadUint64(&transportConnections[transportUTP]),
+		TCPMetadata:    atomic.LoadUint64(&transportMetadata[transportTCP]),
+		UTPMetadata:    atomic.LoadUint64(&transportMetadata[transportUTP]),
 	}
-	return nil
 }
 
-func sendExtensionHandshake(conn net.Conn) error {
-	extensionHandshake := map[string]interface{}{
-		"m": map[string]int{"ut_metadata": 1},
+// dialPeer connects to a peer over TCP and, if EnableUTP is set, uTP at the
+// same time, keeping whichever connects first. Many peers behind NAT are
+// only reachable over uTP.
+func dialPeer(ctx context.Context, peerIP string) (net.Conn, int, error) {
+	type dialResult struct {
+		conn      net.Conn
+		transport int
+		err       error
 	}
-	var handshakeBuffer bytes.Buffer
-	err := bencode.Marshal(&handshakeBuffer, extensionHandshake)
-	if err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(ctx, connectionTimeout)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	attempts := 1
+	go func() {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", peerIP)
+		results <- dialResult{conn, transportTCP, err}
+	}()
+	if EnableUTP {
+		attempts++
+		go func() {
+			conn, err := dialUTP(ctx, peerIP)
+			results <- dialResult{conn, transportUTP, err}
+		}()
 	}
 
-	messageLength := uint32(handshakeBuffer.Len() + 2)
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, messageLength)
-	buf.WriteByte(20)
-	buf.WriteByte(0)
-
-	_, err = conn.Write(append(buf.Bytes(), handshakeBuffer.Bytes()...))
-	return err
+	var errs []string
+	for i := 0; i < attempts; i++ {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", transportNames[result.transport], result.err))
+			continue
+		}
+		// Close the losing connection if it gets through after all
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}(attempts - i - 1)
+		atomic.AddUint64(&transportConnections[result.transport], 1)
+		return result.conn, result.transport, nil
+	}
+	return nil, 0, fmt.Errorf("%s", strings.Join(errs, ", "))
 }
 
+// downloadFromPeer connects to a peer, optionally over MSE, and fetches the
+// info dictionary for infohash (raw 20 bytes)
+func downloadFromPeer(ctx context.Context, peerIP string, infohash []byte, encrypted bool) ([]byte, error) {
+	conn, via, err := dialPeer(ctx, peerIP)
+	if err != nil {
+		// log.Printf("Failed to connect to peer: %v", err)
+		return nil, fmt.Errorf("failed to connect to peer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(metadataTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
-type MetadataResponse struct {
-	// Extension messages support
-	Extensions map[string]int `bencode:"m"`
-	
-	// Metadata size
-	MetadataSize int `bencode:"metadata_size"`
-	
-	// Additional fields (optional)
-	YourIP     string `bencode:"yourip"`
-	ListenPort int    `bencode:"p"`
-	Client     string `bencode:"v"`
+	if encrypted {
+		if conn, err = mseHandshake(conn, infohash, Encryption.cryptoProvide()); err != nil {
+			return nil, fmt.Errorf("%w: encryption: %v", errPeerHandshake, err)
+		}
+	}
+	metadata, err := fetchMetadata(newPeerWire(conn), string(infohash))
+	if err == nil {
+		atomic.AddUint64(&transportMetadata[via], 1)
+	}
+	return metadata, err
 }
 
-func receiveExtensionHandshakeResponse(conn net.Conn) (int, int, error) {
-	resp := make([]byte, 4096)
-	_, err := conn.Read(resp)
+// storeMetadata decodes verified metadata, saves it and indexes it
+func storeMetadata(infohash string, metadata []byte) error {
+	torrent, err := ParseTorrent(infohash, metadata)
 	if err != nil {
-		return 0, 0, err
-	}
-	resp = resp[3:]
-	if resp[1] != 20 || resp[2] != 0 {
-		return 0, 0, fmt.Errorf("invalid extension handshake response")
+		return err
 	}
-	resp = resp[3:]
-	var response MetadataResponse
-	err = bencode.Unmarshal(bytes.NewReader(resp), &response)
+
+	// fmt.Println("Name extracted:", torrent.Name)
+	err = saveMetadataToBoltDB(db, infohash, metadata, torrent.Infohashes()...)
 	if err != nil {
-		return 0, 0, err
+		// log.Printf("Failed to save metadata to BoltDB: %v", err)
+		return fmt.Errorf("failed to save metadata: %v", err)
+	}
+	fmt.Printf("Infohash : %s, Name : %s\n",infohash,torrent.Name)
+	// fmt.Println("Metadata saved to BoltDB successfully")
+	return IndexTorrent(torrent)
+}
+
+// fetchMetadata performs the handshakes on wire and downloads the info
+// dictionary for infohash (raw 20 bytes) over ut_metadata. Peers the remote
+// end sends over ut_pex meanwhile join the fetch for the infohash.
+func fetchMetadata(wire *peerWire, infohash string) ([]byte, error) {
+	if err := wire.handshake(infohash); err != nil {
+		return nil, fmt.Errorf("%w: %v", errPeerHandshake, err)
 	}
-	// fmt.Println(response)
-	utMetadataID := 0
-	if _, ok := response.Extensions["ut_metadata"]; ok {
-		utMetadataID = response.Extensions["ut_metadata"]
+	if err := wire.sendExtensionHandshake(); err != nil {
+		return nil, fmt.Errorf("failed to send extension handshake: %v", err)
 	}
+	hexInfohash := hex.EncodeToString([]byte(infohash))
+	wire.handlers[extUTPex] = pexHandler(hexInfohash)
 
-	metadataSize := response.MetadataSize
+	// Wait for the peer's extension handshake
+	err := wire.dispatch(map[byte]extensionHandler{
+		extHandshake: func([]byte) (bool, error) { return true, nil },
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive extension handshake: %v", err)
+	}
+	swarms.addClient(hexInfohash, wire.remote.Client)
 
+	// fmt.Printf("Peer supports ut_metadata with message ID: %d\n", utMetadataID)
+	// fmt.Printf("Metadata size: %d bytes\n", metadataSize)
+	utMetadataID := wire.remoteExtension("ut_metadata")
 	if utMetadataID == 0 {
-		return 0, 0, fmt.Errorf("peer does not support ut_metadata")
+		awaitPex(wire, hexInfohash)
+		return nil, fmt.Errorf("peer does not support ut_metadata")
+	}
+	if wire.remote.MetadataSize <= 0 {
+		awaitPex(wire, hexInfohash)
+		return nil, fmt.Errorf("peer did not report metadata size")
 	}
-	return utMetadataID, metadataSize, nil
+	if wire.remote.MetadataSize > maxMetadataSize {
+		return nil, fmt.Errorf("metadata size %d exceeds limit", wire.remote.MetadataSize)
+	}
+	return retrieveMetadata(wire, utMetadataID, wire.remote.MetadataSize)
 }
 
-func retrieveMetadata(conn net.Conn, utMetadataID int, metadataSize int) ([]byte, error) {
-	totalPieces := (metadataSize + 16383) / 16384
-	var metadata []byte
-
-	for piece := 0; piece < totalPieces; piece++ {
-		err := requestMetadataPiece(conn, utMetadataID, piece)
-		if err != nil {
-			return nil, fmt.Errorf("failed to request piece %d: %w", piece, err)
-		}
-
-		data, err := receiveMetadataPiece(conn)
-		if err != nil {
-			return nil, fmt.Errorf("failed to receive piece %d: %w", piece, err)
+// retrieveMetadata downloads every piece of the info dictionary, keeping up
+// to metadataPipeline requests outstanding. Pieces may arrive in any order.
+func retrieveMetadata(wire *peerWire, utMetadataID byte, metadataSize int) ([]byte, error) {
+	totalPieces := (metadataSize + metadataPieceSize - 1) / metadataPieceSize
+	pieces := make([][]byte, totalPieces)
+	received, next := 0, 0
+
+	// Keep the pipeline full
+	requestMore := func() error {
+		for ; next < totalPieces && next-received < metadataPipeline; next++ {
+			if err := sendMetadataMessage(wire, utMetadataID, utMetadataRequest, next); err != nil {
+				return fmt.Errorf("failed to request piece %d: %w", next, err)
+			}
 		}
-
-		metadata = append(metadata, data...)
+		return nil
+	}
+	if err := requestMore(); err != nil {
+		return nil, err
 	}
 
-	return metadata, nil
+	err := wire.dispatch(map[byte]extensionHandler{
+		extUTMetadata: func(payload []byte) (bool, error) {
+			msg, data, err := parseMetadataMessage(payload)
+			if err != nil {
+				return false, err
+			}
+			switch msg.MsgType {
+			case utMetadataRequest:
+				// We serve no metadata
+				return false, sendMetadataMessage(wire, utMetadataID, utMetadataReject, msg.Piece)
+			case utMetadataReject:
+				return false, fmt.Errorf("peer rejected piece %d", msg.Piece)
+			case utMetadataData:
+				if msg.Piece < 0 || msg.Piece >= next {
+					return false, fmt.Errorf("unrequested piece %d", msg.Piece)
+				}
+				if msg.TotalSize != metadataSize {
+					return false, fmt.Errorf("total_size %d does not match metadata_size %d", msg.TotalSize, metadataSize)
+				}
+				if pieces[msg.Piece] != nil {
+					return false, nil // Duplicate
+				}
+				if len(data) != metadataPieceLength(msg.Piece, metadataSize) {
+					return false, fmt.Errorf("piece %d has wrong length %d", msg.Piece, len(data))
+				}
+				pieces[msg.Piece] = data
+				received++
+				if received == totalPieces {
+					return true, nil
+				}
+				return false, requestMore()
+			}
+			return false, nil // Unknown message types are ignored
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(pieces, nil), nil
 }
 
-
-func requestMetadataPiece(conn net.Conn, utMetadataID int, piece int) error {
-	var buf bytes.Buffer
-
-	// Create the request payload
-	request := map[string]interface{}{
-		"msg_type": 0,  // Requesting a piece
-		"piece":    piece,
+// metadataPieceLength is the expected length of a piece; all but the last
+// are metadataPieceSize bytes
+func metadataPieceLength(piece, metadataSize int) int {
+	if rest := metadataSize - piece*metadataPieceSize; rest < metadataPieceSize {
+		return rest
 	}
+	return metadataPieceSize
+}
 
-	// Marshal the request into a buffer
-	err := bencode.Marshal(&buf, request)
+// sendMetadataMessage sends a request or reject for a piece, using the
+// peer-specific 'ut_metadata' extension ID
+func sendMetadataMessage(wire *peerWire, utMetadataID byte, msgType, piece int) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, MetadataMessage{MsgType: msgType, Piece: piece})
 	if err != nil {
 		return err
 	}
-
-	// Calculate the message length (including the prefix and ID)
-	messageLength := uint32(buf.Len() + 2) // +2 for the extension ID and message ID
-	var messageBuffer bytes.Buffer
-
-	// Write the message length to the buffer (BigEndian format)
-	binary.Write(&messageBuffer, binary.BigEndian, messageLength)
-
-	// Write the message ID (20 for 'ut_metadata')
-	messageBuffer.WriteByte(20) // Message ID for 'ut_metadata'
-
-	// Write the extension ID (this will depend on the peer's handshake)
-	messageBuffer.WriteByte(byte(utMetadataID)) // Peer-specific 'ut_metadata' extension ID
-
-	// Append the marshaled request (bencoded dictionary) to the message buffer
-	messageBuffer.Write(buf.Bytes())
-
-	// Send the complete message to the connection
-	_, err = conn.Write(messageBuffer.Bytes())
-	return err
+	return wire.writeExtended(utMetadataID, buf.Bytes())
 }
 
-func receiveMetadataPiece(conn net.Conn) ([]byte, error) {
-	response := make([]byte, 655365)
-	_, err := conn.Read(response)
+// parseMetadataMessage splits a ut_metadata message into its dictionary
+// header and, for data messages, the piece data that follows it
+func parseMetadataMessage(payload []byte) (MetadataMessage, []byte, error) {
+	var msg MetadataMessage
+	end, err := bencodeValueEnd(payload, 0)
 	if err != nil {
-		return nil, err
+		return msg, nil, fmt.Errorf("invalid ut_metadata message: %v", err)
+	}
+	if err := decodeBencode(payload[:end], &msg); err != nil {
+		return msg, nil, fmt.Errorf("invalid ut_metadata message: %v", err)
 	}
-	response = response[3:]
-	
-	// if response[1] != 20 {
-	// 	return nil, fmt.Errorf("unexpected message type")
-	// }
-	
-	response = response[3:]
-
-	return response,nil
+	return msg, payload[end:], nil
 }
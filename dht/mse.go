@@ -0,0 +1,222 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Message Stream Encryption configuration
+const (
+	mseKeyLength     = 96  // Bytes in a 768-bit DH public key
+	msePrivateBits   = 160 // Bits in our DH private key
+	mseMaxPad        = 512
+	mseDiscardLength = 1024 // RC4 keystream bytes discarded before use
+)
+
+// crypto_provide and crypto_select bits
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// EncryptionMode selects how metadata connections are made
+type EncryptionMode int
+
+const (
+	// EncryptionPlaintext only speaks the plaintext BitTorrent handshake
+	EncryptionPlaintext EncryptionMode = iota
+	// EncryptionPrefer offers MSE with RC4 or plaintext payloads and retries
+	// in plaintext if the encrypted handshake fails
+	EncryptionPrefer
+	// EncryptionRequire only connects over MSE with RC4
+	EncryptionRequire
+)
+
+// Encryption is the mode used for metadata connections
+var Encryption = EncryptionPrefer
+
+var (
+	mseP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+			"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+			"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+			"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG  = big.NewInt(2)
+	mseVC = make([]byte, 8) // Verification constant
+)
+
+// handshakeAttempts returns whether to encrypt on each connection attempt
+// for a mode, the fallback coming second
+func (m EncryptionMode) handshakeAttempts() []bool {
+	switch m {
+	case EncryptionPrefer:
+		return []bool{true, false}
+	case EncryptionRequire:
+		return []bool{true}
+	default:
+		return []bool{false}
+	}
+}
+
+// cryptoProvide is the crypto_provide field we send in a mode
+func (m EncryptionMode) cryptoProvide() uint32 {
+	if m == EncryptionRequire {
+		return cryptoRC4
+	}
+	return cryptoRC4 | cryptoPlaintext
+}
+
+// mseConn is a connection after the MSE handshake. Reads and writes pass
+// through RC4 unless the peer selected a plaintext payload.
+type mseConn struct {
+	net.Conn
+	r   io.Reader
+	enc cipher.Stream // Nil for plaintext payloads
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	out := make([]byte, len(b))
+	c.enc.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// msePublicKey encodes a DH value as a fixed-length big-endian key
+func msePublicKey(n *big.Int) []byte {
+	key := make([]byte, mseKeyLength)
+	return n.FillBytes(key)
+}
+
+// mseCipher returns an RC4 stream keyed for one direction, with the first
+// mseDiscardLength bytes of keystream discarded
+func mseCipher(name string, secret, skey []byte) (cipher.Stream, error) {
+	c, err := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	if err != nil {
+		return nil, err
+	}
+	discard := make([]byte, mseDiscardLength)
+	c.XORKeyStream(discard, discard)
+	return c, nil
+}
+
+func msePad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// mseHandshake performs the initiating side of the MSE/PE handshake on conn
+// with skey (the raw infohash) and returns the connection to speak the
+// BitTorrent protocol over
+func mseHandshake(conn net.Conn, skey []byte, provide uint32) (net.Conn, error) {
+	// 1. A->B: Ya, PadA
+	xa, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), msePrivateBits))
+	if err != nil {
+		return nil, err
+	}
+	padA, err := msePad()
+	if err != nil {
+		return nil, err
+	}
+	ya := msePublicKey(new(big.Int).Exp(mseG, xa, mseP))
+	if _, err := conn.Write(append(ya, padA...)); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB. PadB is skipped while looking for B's VC below.
+	r := bufio.NewReader(conn)
+	yb := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, fmt.Errorf("failed to read peer key: %v", err)
+	}
+	secret := msePublicKey(new(big.Int).Exp(new(big.Int).SetBytes(yb), xa, mseP))
+	enc, err := mseCipher("keyA", secret, skey)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := mseCipher("keyB", secret, skey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA).
+	// PadC and IA are left empty; the BitTorrent handshake follows.
+	req2 := mseHash([]byte("req2"), skey)
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	header := make([]byte, len(mseVC)+8)
+	copy(header, mseVC)
+	binary.BigEndian.PutUint32(header[len(mseVC):], provide)
+	enc.XORKeyStream(header, header)
+	msg := append(mseHash([]byte("req1"), secret), req2...)
+	if _, err := conn.Write(append(msg, header...)); err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD). B's VC marks the
+	// end of PadB.
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	var window []byte
+	for !bytes.HasSuffix(window, vc) {
+		if len(window) >= mseMaxPad+len(vc) {
+			return nil, fmt.Errorf("verification constant not found")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read peer response: %v", err)
+		}
+		window = append(window, b)
+	}
+	stream := cipher.StreamReader{S: dec, R: r}
+	selected := make([]byte, 6)
+	if _, err := io.ReadFull(stream, selected); err != nil {
+		return nil, fmt.Errorf("failed to read crypto_select: %v", err)
+	}
+	padLength := int(binary.BigEndian.Uint16(selected[4:]))
+	if padLength > mseMaxPad {
+		return nil, fmt.Errorf("padding too long: %d bytes", padLength)
+	}
+	if _, err := io.CopyN(io.Discard, stream, int64(padLength)); err != nil {
+		return nil, fmt.Errorf("failed to read padding: %v", err)
+	}
+
+	switch cryptoSelect := binary.BigEndian.Uint32(selected); {
+	case cryptoSelect == cryptoRC4 && provide&cryptoRC4 != 0:
+		return &mseConn{Conn: conn, r: stream, enc: enc}, nil
+	case cryptoSelect == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return &mseConn{Conn: conn, r: r}, nil
+	default:
+		return nil, fmt.Errorf("peer selected unsupported crypto method %d", cryptoSelect)
+	}
+}
@@ -0,0 +1,197 @@
+package dht
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// Node identity configuration (BEP 42)
+const (
+	nodeBucketName  = "Node"
+	externalIPVotes = 5   // Distinct nodes that must agree before we trust an external IP
+	maxIPCandidates = 100 // Reported external IPs tracked before the votes are reset
+)
+
+var (
+	bep42MaskV4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	bep42MaskV6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+	castagnoli  = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// nodeIdentity is our node ID and the external IP it was derived from
+type nodeIdentity struct {
+	mu    sync.RWMutex
+	id    NodeID
+	ip    net.IP
+	votes map[string]map[string]bool // Voter IPs per reported external IP
+}
+
+var identity = &nodeIdentity{id: randomNodeID(), votes: make(map[string]map[string]bool)}
+
+// localID returns our current node ID
+func localID() NodeID {
+	identity.mu.RLock()
+	defer identity.mu.RUnlock()
+	return identity.id
+}
+
+// ExternalIP returns the external IP our node ID is derived from, if known
+func ExternalIP() net.IP {
+	identity.mu.RLock()
+	defer identity.mu.RUnlock()
+	return identity.ip
+}
+
+// bep42Prefix computes the CRC32-C of the masked IP with r mixed into the
+// top bits, which determines the first 21 bits of a secure node ID.
+func bep42Prefix(ip net.IP, r byte) (uint32, bool) {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		masked = make([]byte, len(bep42MaskV4))
+		for i := range masked {
+			masked[i] = ip4[i] & bep42MaskV4[i]
+		}
+	} else if ip16 := ip.To16(); ip16 != nil {
+		masked = make([]byte, len(bep42MaskV6))
+		for i := range masked {
+			masked[i] = ip16[i] & bep42MaskV6[i]
+		}
+	} else {
+		return 0, false
+	}
+	masked[0] |= (r & 0x07) << 5
+	return crc32.Checksum(masked, castagnoli), true
+}
+
+// secureNodeID generates a random node ID that is valid for ip under BEP 42
+func secureNodeID(ip net.IP) (NodeID, error) {
+	id := randomNodeID()
+	r := id[nodeIDLength-1] & 0x07
+	crc, ok := bep42Prefix(ip, r)
+	if !ok {
+		return id, fmt.Errorf("invalid IP address: %v", ip)
+	}
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	id[nodeIDLength-1] = r
+	return id, nil
+}
+
+// isSecureNodeID reports whether id is valid for ip under BEP 42
+func isSecureNodeID(id NodeID, ip net.IP) bool {
+	crc, ok := bep42Prefix(ip, id[nodeIDLength-1])
+	if !ok {
+		return false
+	}
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// loadNodeIdentity restores our node ID and external IP from the database,
+// creating and persisting a random ID on first run.
+func loadNodeIdentity() error {
+	var id, ip []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(nodeBucketName))
+		if bucket == nil {
+			return nil
+		}
+		id = append(id, bucket.Get([]byte("id"))...)
+		ip = append(ip, bucket.Get([]byte("ip"))...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load node ID: %v", err)
+	}
+
+	identity.mu.Lock()
+	if stored, ok := nodeIDFromString(string(id)); ok {
+		identity.id = stored
+		if len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+			identity.ip = net.IP(ip)
+		}
+	}
+	current, currentIP := identity.id, identity.ip
+	identity.mu.Unlock()
+
+	routingTable.Rebase(current)
+	routingTable6.Rebase(current)
+	return saveNodeIdentity(current, currentIP)
+}
+
+// saveNodeIdentity persists our node ID and external IP. It is called
+// without identity.mu held so that localID never waits on the database.
+func saveNodeIdentity(id NodeID, ip net.IP) error {
+	if db == nil {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(nodeBucketName))
+		if err != nil {
+			return fmt.Errorf("failed to create bucket: %v", err)
+		}
+		if err := bucket.Put([]byte("id"), id[:]); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("ip"), ip)
+	})
+}
+
+// observeExternalIP records the external IP the node at voter reported for
+// us in the compact "ip" field of its response. Once enough distinct nodes
+// agree on an IP our current ID is not valid for, a new BEP 42 ID is
+// generated; a single node answering many queries counts once. Both
+// sockets report to us, so once our ID is derived from an IPv4 address,
+// IPv6 reports are ignored and the ID does not flip between families.
+func observeExternalIP(compact string, voter net.IP) {
+	var ip net.IP
+	switch len(compact) {
+	case 6:
+		ip = net.IP([]byte(compact[:4]))
+	case 18:
+		ip = net.IP([]byte(compact[:16]))
+	default:
+		return
+	}
+
+	identity.mu.Lock()
+	if ip.To4() == nil && identity.ip.To4() != nil {
+		identity.mu.Unlock()
+		return
+	}
+	if identity.ip.Equal(ip) && isSecureNodeID(identity.id, ip) {
+		identity.mu.Unlock()
+		return
+	}
+	voters, ok := identity.votes[ip.String()]
+	if !ok {
+		if len(identity.votes) >= maxIPCandidates {
+			identity.votes = make(map[string]map[string]bool)
+		}
+		voters = make(map[string]bool)
+		identity.votes[ip.String()] = voters
+	}
+	voters[voter.String()] = true
+	if len(voters) < externalIPVotes {
+		identity.mu.Unlock()
+		return
+	}
+
+	id, err := secureNodeID(ip)
+	if err != nil {
+		identity.mu.Unlock()
+		return
+	}
+	identity.id = id
+	identity.ip = ip
+	identity.votes = make(map[string]map[string]bool)
+	identity.mu.Unlock()
+
+	routingTable.Rebase(id)
+	routingTable6.Rebase(id)
+	saveNodeIdentity(id, ip)
+}
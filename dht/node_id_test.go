@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// Test vectors from BEP 42
+var bep42Vectors = []struct {
+	ip string
+	id string
+}{
+	{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func TestIsSecureNodeID(t *testing.T) {
+	for _, v := range bep42Vectors {
+		raw, _ := hex.DecodeString(v.id)
+		id, ok := nodeIDFromString(string(raw))
+		if !ok {
+			t.Fatalf("invalid test vector %s", v.id)
+		}
+		if !isSecureNodeID(id, net.ParseIP(v.ip)) {
+			t.Errorf("isSecureNodeID(%s, %s) = false, want true", v.id, v.ip)
+		}
+		if isSecureNodeID(id, net.ParseIP("8.8.8.8")) {
+			t.Errorf("isSecureNodeID(%s, 8.8.8.8) = true, want false", v.id)
+		}
+	}
+}
+
+func TestSecureNodeID(t *testing.T) {
+	for _, ip := range []string{"124.31.75.21", "2001:db8::1"} {
+		id, err := secureNodeID(net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("secureNodeID(%s): %v", ip, err)
+		}
+		if !isSecureNodeID(id, net.ParseIP(ip)) {
+			t.Errorf("secureNodeID(%s) = %s, which is not secure for it", ip, id)
+		}
+	}
+	if _, err := secureNodeID(nil); err == nil {
+		t.Error("secureNodeID(nil) did not fail")
+	}
+}
+
+func TestObserveExternalIP(t *testing.T) {
+	saved := identity
+	identity = &nodeIdentity{id: randomNodeID(), votes: make(map[string]map[string]bool)}
+	defer func() { identity = saved }()
+
+	v4 := string(net.ParseIP("124.31.75.21").To4()) + "\x1a\xe1"
+	v6 := string(net.ParseIP("2001:db8::1")) + "\x1a\xe1"
+
+	// One node repeating itself is a single vote
+	for i := 0; i < 2*externalIPVotes; i++ {
+		observeExternalIP(v4, net.ParseIP("1.2.3.4"))
+	}
+	if ExternalIP() != nil {
+		t.Fatalf("external IP set to %v by a single voter", ExternalIP())
+	}
+
+	for i := 0; i < externalIPVotes; i++ {
+		observeExternalIP(v4, net.IPv4(1, 2, 3, byte(i)))
+	}
+	if !ExternalIP().Equal(net.ParseIP("124.31.75.21")) || !isSecureNodeID(localID(), ExternalIP()) {
+		t.Fatalf("external IP = %v after %d voters, want 124.31.75.21", ExternalIP(), externalIPVotes)
+	}
+
+	// IPv6 reports do not replace an IPv4 identity
+	for i := 0; i < externalIPVotes; i++ {
+		observeExternalIP(v6, net.IPv4(5, 6, 7, byte(i)))
+	}
+	if !ExternalIP().Equal(net.ParseIP("124.31.75.21")) {
+		t.Errorf("external IP = %v after IPv6 votes, want 124.31.75.21", ExternalIP())
+	}
+}
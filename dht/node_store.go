@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jackpal/bencode-go"
+)
+
+// Node persistence configuration
+const (
+	nodesBucketName  = "Nodes"
+	nodeSaveInterval = 5 * time.Minute
+	maxSavedNodes    = 5000
+)
+
+// BEP 51 support as stored in savedNode
+const (
+	bep51Unknown     = 0
+	bep51Supported   = 1
+	bep51Unsupported = -1
+)
+
+// savedNode is the on-disk form of a known node
+type savedNode struct {
+	ID       string `bencode:"id"`
+	Addr     string `bencode:"addr"`
+	LastSeen int64  `bencode:"last_seen"`
+	Failures int    `bencode:"failures"`
+	BEP51    int    `bencode:"bep51"`
+}
+
+// SaveNodes writes the routing tables and the nodes known to support BEP 51
+// to the Nodes bucket, replacing what was saved before.
+func SaveNodes() error {
+	if db == nil {
+		return fmt.Errorf("database not initialised")
+	}
+
+	saved := make(map[string]savedNode)
+	for _, table := range []*RoutingTable{routingTable, routingTable6} {
+		for _, node := range table.Nodes() {
+			saved[node.Addr] = savedNode{
+				ID:       node.ID.raw(),
+				Addr:     node.Addr,
+				LastSeen: node.LastSeen.Unix(),
+				Failures: node.Failures,
+			}
+		}
+	}
+	for _, address := range sampler.supportedNodes() {
+		if len(saved) >= maxSavedNodes {
+			break
+		}
+		node, ok := saved[address]
+		if !ok {
+			node = savedNode{Addr: address, LastSeen: time.Now().Unix()}
+		}
+		saved[address] = node
+	}
+	for address, node := range saved {
+		if supported, known := sampler.support(address); known {
+			node.BEP51 = bep51Unsupported
+			if supported {
+				node.BEP51 = bep51Supported
+			}
+			saved[address] = node
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(nodesBucketName)) != nil {
+			if err := tx.DeleteBucket([]byte(nodesBucketName)); err != nil {
+				return fmt.Errorf("failed to clear bucket: %v", err)
+			}
+		}
+		bucket, err := tx.CreateBucket([]byte(nodesBucketName))
+		if err != nil {
+			return fmt.Errorf("failed to create bucket: %v", err)
+		}
+		for address, node := range saved {
+			var buf bytes.Buffer
+			if err := bencode.Marshal(&buf, node); err != nil {
+				return fmt.Errorf("failed to marshal node %s: %v", address, err)
+			}
+			if err := bucket.Put([]byte(address), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadSavedNodes reads the nodes saved by SaveNodes
+func loadSavedNodes() ([]savedNode, error) {
+	if db == nil {
+		return nil, nil
+	}
+	var nodes []savedNode
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(nodesBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var node savedNode
+			if err := decodeBencode(v, &node); err != nil || node.Addr == "" {
+				return nil // Skip corrupt entries rather than failing the load
+			}
+			nodes = append(nodes, node)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load nodes: %v", err)
+	}
+	return nodes, nil
+}
+
+// restoreNodes loads the saved nodes back into the routing tables and the
+// sampler, returning their addresses so the crawler can start from them.
+func restoreNodes() []string {
+	nodes, err := loadSavedNodes()
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, saved := range nodes {
+		switch saved.BEP51 {
+		case bep51Supported:
+			sampler.setSupport(saved.Addr, true)
+			sampler.add(saved.Addr)
+		case bep51Unsupported:
+			sampler.setSupport(saved.Addr, false)
+		}
+		if id, ok := nodeIDFromString(saved.ID); ok {
+			tableForAddr(saved.Addr).Restore(Node{
+				ID:       id,
+				Addr:     saved.Addr,
+				LastSeen: time.Unix(saved.LastSeen, 0),
+				Failures: saved.Failures,
+			})
+		}
+		addresses = append(addresses, saved.Addr)
+	}
+	return addresses
+}
+
+// persistNodes saves the node table every nodeSaveInterval until ctx is
+// cancelled. The final save on shutdown is made by CrawlDHT.
+func persistNodes(ctx context.Context) {
+	ticker := time.NewTicker(nodeSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			SaveNodes()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
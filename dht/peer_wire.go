@@ -0,0 +1,220 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Peer wire configuration
+const (
+	protocolName         = "BitTorrent protocol"
+	peerHandshakeLength  = 49 + len(protocolName)
+	maxPeerMessageLength = 1 << 20 // Large enough for the bitfield of any sane torrent
+	peerID               = "-DE0001-123456789012"
+)
+
+// Peer wire message IDs
+const (
+	msgExtended = 20 // BEP 10
+)
+
+// Extended message IDs we advertise in our extension handshake. Peers send
+// us extended messages using these IDs, and we send them messages using the
+// IDs from their handshake.
+const (
+	extHandshake  = 0
+	extUTMetadata = 1
+	extUTPex      = 2
+)
+
+// errPeerHandshake wraps errors from before the BitTorrent handshake
+// completed, which may mean the peer wants the other encryption mode
+var errPeerHandshake = errors.New("handshake failed")
+
+var localExtensions = map[string]int{
+	"ut_metadata": extUTMetadata,
+	"ut_pex":      extUTPex,
+}
+
+// ExtensionHandshake is the BEP 10 extension handshake dictionary
+type ExtensionHandshake struct {
+	// Extension messages supported, mapped to their extended message IDs
+	Extensions map[string]int `bencode:"m"`
+
+	// Size of the info dictionary (BEP 9)
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+
+	// Additional fields (optional)
+	YourIP     string `bencode:"yourip,omitempty"`
+	ListenPort int    `bencode:"p,omitempty"`
+	Client     string `bencode:"v,omitempty"`
+}
+
+// peerMessage is one length-prefixed peer wire message. Keep-alives are
+// returned with keepAlive set and no ID or payload.
+type peerMessage struct {
+	keepAlive bool
+	id        byte
+	payload   []byte
+}
+
+// extensionHandler handles the payload of one extended message, reporting
+// whether dispatch should stop
+type extensionHandler func(payload []byte) (done bool, err error)
+
+// peerWire reads and writes framed peer wire messages on a connection
+type peerWire struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	remote   ExtensionHandshake        // Set once the peer's extension handshake arrives
+	handlers map[byte]extensionHandler // Used by every dispatch for IDs it has no handler for
+}
+
+func newPeerWire(conn net.Conn) *peerWire {
+	return &peerWire{conn: conn, r: bufio.NewReader(conn), handlers: make(map[byte]extensionHandler)}
+}
+
+// handshake exchanges the BitTorrent handshake for infohash (raw 20 bytes)
+// and checks that the peer is serving the same torrent and supports the
+// extension protocol.
+func (w *peerWire) handshake(infohash string) error {
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // Extension protocol (BEP 10)
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(len(protocolName)))
+	buf.WriteString(protocolName)
+	buf.Write(reserved)
+	buf.WriteString(infohash)
+	buf.WriteString(peerID)
+	if _, err := w.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	resp := make([]byte, peerHandshakeLength)
+	if _, err := io.ReadFull(w.r, resp); err != nil {
+		return err
+	}
+	if int(resp[0]) != len(protocolName) || string(resp[1:1+len(protocolName)]) != protocolName {
+		return fmt.Errorf("unexpected protocol in peer handshake")
+	}
+	offset := 1 + len(protocolName)
+	if resp[offset+5]&0x10 == 0 {
+		return fmt.Errorf("peer does not support extension protocol")
+	}
+	if string(resp[offset+8:offset+28]) != infohash {
+		return fmt.Errorf("peer handshake infohash mismatch")
+	}
+	return nil
+}
+
+// readMessage reads one message, returning keep-alives as such
+func (w *peerWire) readMessage() (peerMessage, error) {
+	var length uint32
+	if err := binary.Read(w.r, binary.BigEndian, &length); err != nil {
+		return peerMessage{}, err
+	}
+	if length == 0 {
+		return peerMessage{keepAlive: true}, nil
+	}
+	if length > maxPeerMessageLength {
+		return peerMessage{}, fmt.Errorf("peer message too long: %d bytes", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(w.r, msg); err != nil {
+		return peerMessage{}, err
+	}
+	return peerMessage{id: msg[0], payload: msg[1:]}, nil
+}
+
+// writeMessage writes one message with the given ID and payload
+func (w *peerWire) writeMessage(id byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)+1))
+	buf[4] = id
+	_, err := w.conn.Write(append(buf, payload...))
+	return err
+}
+
+// readExtended reads messages until an extended message arrives, skipping
+// keep-alives and everything else (bitfield, have, choke, ...)
+func (w *peerWire) readExtended() (byte, []byte, error) {
+	for {
+		msg, err := w.readMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if msg.keepAlive || msg.id != msgExtended {
+			continue
+		}
+		if len(msg.payload) == 0 {
+			return 0, nil, fmt.Errorf("empty extended message")
+		}
+		return msg.payload[0], msg.payload[1:], nil
+	}
+}
+
+// writeExtended sends an extended message using the peer's ID for it
+func (w *peerWire) writeExtended(extID byte, payload []byte) error {
+	return w.writeMessage(msgExtended, append([]byte{extID}, payload...))
+}
+
+// sendExtensionHandshake advertises the extensions we support
+func (w *peerWire) sendExtensionHandshake() error {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, ExtensionHandshake{Extensions: localExtensions}); err != nil {
+		return err
+	}
+	return w.writeExtended(extHandshake, buf.Bytes())
+}
+
+// remoteExtension returns the peer's extended message ID for name, or 0 if
+// the peer does not support it
+func (w *peerWire) remoteExtension(name string) byte {
+	id := w.remote.Extensions[name]
+	if id <= 0 || id > 255 {
+		return 0
+	}
+	return byte(id)
+}
+
+// dispatch reads extended messages and hands them to the handler registered
+// for their extended ID until a handler reports it is done. The extension
+// handshake is recorded in w.remote before its handler, if any, runs.
+// Messages with no handler there or in w.handlers are ignored.
+func (w *peerWire) dispatch(handlers map[byte]extensionHandler) error {
+	for {
+		extID, payload, err := w.readExtended()
+		if err != nil {
+			return err
+		}
+		if extID == extHandshake {
+			var remote ExtensionHandshake
+			if err := decodeBencode(payload, &remote); err != nil {
+				return fmt.Errorf("invalid extension handshake: %v", err)
+			}
+			w.remote = remote
+		}
+		handler, ok := handlers[extID]
+		if !ok {
+			handler, ok = w.handlers[extID]
+		}
+		if !ok {
+			continue
+		}
+		done, err := handler(payload)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
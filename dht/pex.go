@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+)
+
+// Peer exchange configuration
+const (
+	pexWait         = 10 * time.Second // How long a peer without the metadata is kept for its peer list
+	maxPexAdded     = 200              // Added peers taken from one message
+	compactPeerLen  = 6
+	compactPeer6Len = 18
+)
+
+// PexMessage is a ut_pex message. Peers are compact addresses; the flags
+// and dropped peers are not used.
+type PexMessage struct {
+	Added    string `bencode:"added"`
+	Added6   string `bencode:"added6"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// parsePexMessage returns the addresses of the peers added in a ut_pex
+// message
+func parsePexMessage(payload []byte) ([]string, error) {
+	var msg PexMessage
+	if err := decodeBencode(payload, &msg); err != nil {
+		return nil, fmt.Errorf("invalid ut_pex message: %v", err)
+	}
+	if len(msg.Added)%compactPeerLen != 0 || len(msg.Added6)%compactPeer6Len != 0 {
+		return nil, fmt.Errorf("invalid ut_pex message: truncated peer list")
+	}
+
+	var compact []string
+	for i := 0; i < len(msg.Added) && len(compact) < maxPexAdded; i += compactPeerLen {
+		compact = append(compact, msg.Added[i:i+compactPeerLen])
+	}
+	for i := 0; i < len(msg.Added6) && len(compact) < maxPexAdded; i += compactPeer6Len {
+		compact = append(compact, msg.Added6[i:i+compactPeer6Len])
+	}
+	return decodeCompactPeers(compact), nil
+}
+
+// pexHandler handles ut_pex messages for infohash (hex), handing the peers
+// to its metadata fetch and recording them in its swarm
+func pexHandler(infohash string) extensionHandler {
+	return func(payload []byte) (bool, error) {
+		peers, err := parsePexMessage(payload)
+		if err != nil {
+			// A bad peer list is no reason to drop the connection
+			return false, nil
+		}
+		if len(peers) == 0 {
+			return false, nil
+		}
+		fetcher.fetch(infohash, peers...)
+		swarms.addPeers(infohash, peers...)
+		return false, nil
+	}
+}
+
+// awaitPex waits up to pexWait for a peer that cannot give us the metadata
+// to send its peer list, if it supports ut_pex
+func awaitPex(wire *peerWire, infohash string) {
+	if wire.remoteExtension("ut_pex") == 0 {
+		return
+	}
+	wire.conn.SetDeadline(time.Now().Add(pexWait))
+	handle := pexHandler(infohash)
+	wire.dispatch(map[byte]extensionHandler{
+		extUTPex: func(payload []byte) (bool, error) {
+			_, err := handle(payload)
+			return true, err
+		},
+	})
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"fmt"
+)
+
+// Structs for the KRPC ping request and response
+type PingReq struct {
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+	Q string `bencode:"q"`
+	A struct {
+		ID string `bencode:"id"`
+	} `bencode:"a"`
+}
+
+type PingResp struct {
+	R struct {
+		ID string `bencode:"id"`
+	} `bencode:"r"`
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+}
+
+func (r *PingReq) setTransactionID(t string) { r.T = t }
+
+// Function to ping a DHT node and return its node ID
+func sendPing(nodeID, address string) (NodeID, error) {
+	t, err := getTransport()
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	req := PingReq{Y: "q", Q: "ping"}
+	req.A.ID = nodeID
+
+	resp, err := t.query(address, &req, requestTimeout)
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	var response PingResp
+	if err := decodeBencode(resp, &response); err != nil {
+		return NodeID{}, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	id, ok := nodeIDFromString(response.R.ID)
+	if !ok {
+		return NodeID{}, fmt.Errorf("invalid node ID in ping response")
+	}
+	return id, nil
+}
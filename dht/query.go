@@ -8,10 +8,10 @@ import (
 	"github.com/boltdb/bolt"
 )
 
+// SearchResult is a torrent matching a search query
 type SearchResult struct {
-	Infohash string
-	Name     string
-	Files    []string
+	Torrent
+	Swarm SwarmStats
 }
 
 // QueryResult represents a search result with its score
@@ -86,20 +86,23 @@ func Query(query string) ([]SearchResult, error) {
         // Create sorted results
         results := make([]QueryResult, 0, len(scoreMap))
         for infohash, score := range scoreMap {
-            name, files := ParseMetadata(ShowMetadataForInfohash(infohash))
+            torrent, err := GetTorrent(infohash)
+            if err != nil {
+                continue
+            }
+            swarm, _ := GetSwarmStats(torrent.Infohash)
             results = append(results, QueryResult{
-                SearchResult: SearchResult{
-                    Infohash: infohash,
-                    Name:     name,
-                    Files:    files,
-                },
-                Score: score,
+                SearchResult: SearchResult{Torrent: *torrent, Swarm: swarm},
+                Score:        score,
             })
         }
 
-        // Sort results by score
+        // Sort results by score, the more popular first among equals
         sort.Slice(results, func(i, j int) bool {
-            return results[i].Score > results[j].Score
+            if results[i].Score != results[j].Score {
+                return results[i].Score > results[j].Score
+            }
+            return results[i].Swarm.Popularity() > results[j].Swarm.Popularity()
         })
 
         // Convert to final format
@@ -110,4 +113,12 @@ func Query(query string) ([]SearchResult, error) {
 
         return finalResults, nil
     }
-}
\ No newline at end of file
+}
+
+// SortByPopularity orders search results by swarm popularity, most popular
+// first, keeping the relevance order among equals
+func SortByPopularity(results []SearchResult) {
+    sort.SliceStable(results, func(i, j int) bool {
+        return results[i].Swarm.Popularity() > results[j].Swarm.Popularity()
+    })
+}
@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Outbound rate limits for KRPC traffic
+const (
+	maxQueriesPerSecond   = 200 // Queries sent to all nodes
+	maxQueryBurst         = 400
+	maxBytesPerSecond     = 256 * 1024 // Queries and replies sent to all nodes
+	maxBytesBurst         = 512 * 1024
+	maxIPQueriesPerSecond = 2 // Queries sent to one IP
+	maxIPQueryBurst       = 5
+	queryBackoffBase      = 15 * time.Second // Backoff after the first unanswered query
+	queryBackoffMax       = 30 * time.Minute
+)
+
+var (
+	errBackoff     = errors.New("node is backing off after unanswered queries")
+	errRateLimited = errors.New("outbound rate limit exceeded")
+)
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) tokenBucket {
+	return tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// delay returns how long it takes until n tokens are available
+func (b *tokenBucket) delay(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// allow takes n tokens only if they are available now
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// ipLimit is the query budget and backoff state of one destination IP
+type ipLimit struct {
+	bucket       tokenBucket
+	failures     int // Consecutive unanswered queries, until the backoff peaks
+	backoffUntil time.Time
+	lastUsed     time.Time
+}
+
+// rateLimiter paces outgoing KRPC packets globally and per destination IP,
+// and backs off from IPs that stop answering
+type rateLimiter struct {
+	mu      sync.Mutex
+	queries tokenBucket
+	bytes   tokenBucket
+	ips     map[string]*ipLimit
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		queries: newTokenBucket(maxQueriesPerSecond, maxQueryBurst),
+		bytes:   newTokenBucket(maxBytesPerSecond, maxBytesBurst),
+		ips:     make(map[string]*ipLimit),
+	}
+}
+
+// ipLimitFor returns the state of ip. Callers hold l.mu.
+func (l *rateLimiter) ipLimitFor(ip net.IP, now time.Time) *ipLimit {
+	key := ip.String()
+	lim, ok := l.ips[key]
+	if !ok {
+		lim = &ipLimit{bucket: newTokenBucket(maxIPQueriesPerSecond, maxIPQueryBurst)}
+		l.ips[key] = lim
+	}
+	lim.lastUsed = now
+	return lim
+}
+
+// reserveQuery books a query of size bytes to ip and returns how long to
+// wait before sending it. It returns errBackoff if ip is backing off, and
+// errRateLimited without booking anything if the wait would exceed
+// maxWait, so that the buckets' debt and the wait stay bounded however many
+// queries are queued.
+func (l *rateLimiter) reserveQuery(ip net.IP, size int, maxWait time.Duration) (time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim := l.ipLimitFor(ip, now)
+	if now.Before(lim.backoffUntil) {
+		return 0, errBackoff
+	}
+	wait := lim.bucket.delay(now, 1)
+	if w := l.queries.delay(now, 1); w > wait {
+		wait = w
+	}
+	if w := l.bytes.delay(now, float64(size)); w > wait {
+		wait = w
+	}
+	if wait > maxWait {
+		return 0, errRateLimited
+	}
+	lim.bucket.tokens--
+	l.queries.tokens--
+	l.bytes.tokens -= float64(size)
+	return wait, nil
+}
+
+// allowReply reports whether a reply of size bytes fits in the byte budget.
+// Replies are dropped rather than delayed so that answering other nodes
+// never holds up our own queries.
+func (l *rateLimiter) allowReply(size int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytes.allow(time.Now(), float64(size))
+}
+
+// answered resets the backoff of ip after it replied to a query
+func (l *rateLimiter) answered(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lim, ok := l.ips[ip.String()]; ok {
+		lim.failures = 0
+		lim.backoffUntil = time.Time{}
+	}
+}
+
+// unanswered backs off from ip after a query to it timed out, doubling the
+// backoff with each consecutive timeout
+func (l *rateLimiter) unanswered(ip net.IP) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim := l.ipLimitFor(ip, now)
+	backoff := queryBackoffBase << lim.failures
+	if backoff >= queryBackoffMax {
+		backoff = queryBackoffMax
+	} else {
+		lim.failures++
+	}
+	lim.backoffUntil = now.Add(backoff)
+}
+
+// prune forgets IPs that have not been queried for maxAge and are not
+// backing off
+func (l *rateLimiter) prune(maxAge time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, lim := range l.ips {
+		if now.Sub(lim.lastUsed) > maxAge && now.After(lim.backoffUntil) {
+			delete(l.ips, key)
+		}
+	}
+}
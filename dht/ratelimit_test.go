@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReserveQueryPerIP(t *testing.T) {
+	l := newRateLimiter()
+	ip := net.ParseIP("10.0.0.1")
+	for i := 0; i < maxIPQueryBurst; i++ {
+		if wait, err := l.reserveQuery(ip, 100, 0); wait != 0 || err != nil {
+			t.Fatalf("query %d within the burst: wait %v, %v", i, wait, err)
+		}
+	}
+
+	// The next query waits for the IP's bucket to refill one token
+	wait, err := l.reserveQuery(ip, 100, time.Second)
+	perQuery := time.Second / maxIPQueriesPerSecond
+	if err != nil || wait < perQuery*9/10 || wait > perQuery {
+		t.Errorf("query past the burst: wait %v, %v; want about %v", wait, err, perQuery)
+	}
+	// and one that cannot be sent within maxWait books nothing
+	tokens := l.ips[ip.String()].bucket.tokens
+	if _, err := l.reserveQuery(ip, 100, perQuery); !errors.Is(err, errRateLimited) {
+		t.Errorf("query past maxWait: %v, want errRateLimited", err)
+	}
+	if l.ips[ip.String()].bucket.tokens < tokens {
+		t.Error("rate limited query took a token")
+	}
+
+	// Other IPs have their own budget
+	if wait, err := l.reserveQuery(net.ParseIP("10.0.0.2"), 100, 0); wait != 0 || err != nil {
+		t.Errorf("query to another IP: wait %v, %v", wait, err)
+	}
+}
+
+func TestReserveQueryGlobal(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < maxQueryBurst; i++ {
+		ip := net.ParseIP(fmt.Sprintf("10.0.%d.%d", i>>8, i&0xff))
+		if wait, err := l.reserveQuery(ip, 100, 0); wait != 0 || err != nil {
+			t.Fatalf("query %d within the global burst: wait %v, %v", i, wait, err)
+		}
+	}
+	fresh := net.ParseIP("10.1.0.1")
+	if _, err := l.reserveQuery(fresh, 100, 0); !errors.Is(err, errRateLimited) {
+		t.Errorf("query past the global burst: %v, want errRateLimited", err)
+	}
+	if wait, err := l.reserveQuery(fresh, 100, time.Second); err != nil || wait == 0 {
+		t.Errorf("query past the global burst: wait %v, %v", wait, err)
+	}
+
+	// The byte budget applies on its own
+	l = newRateLimiter()
+	if _, err := l.reserveQuery(fresh, maxBytesBurst+maxBytesPerSecond, time.Second/2); !errors.Is(err, errRateLimited) {
+		t.Errorf("query past the byte budget: %v, want errRateLimited", err)
+	}
+}
+
+func TestQueryBackoff(t *testing.T) {
+	l := newRateLimiter()
+	ip := net.ParseIP("10.0.0.1")
+	backoff := func() time.Duration {
+		return time.Until(l.ips[ip.String()].backoffUntil)
+	}
+
+	l.unanswered(ip)
+	if _, err := l.reserveQuery(ip, 100, time.Second); !errors.Is(err, errBackoff) {
+		t.Fatalf("query after a timeout: %v, want errBackoff", err)
+	}
+	if b := backoff(); b > queryBackoffBase || b < queryBackoffBase-time.Second {
+		t.Errorf("first backoff %v, want %v", b, queryBackoffBase)
+	}
+	l.unanswered(ip)
+	if b := backoff(); b > 2*queryBackoffBase || b < 2*queryBackoffBase-time.Second {
+		t.Errorf("second backoff %v, want %v", b, 2*queryBackoffBase)
+	}
+	for i := 0; i < 20; i++ {
+		l.unanswered(ip)
+	}
+	if b := backoff(); b > queryBackoffMax || b < queryBackoffMax-time.Second {
+		t.Errorf("backoff after many timeouts %v, want the cap of %v", b, queryBackoffMax)
+	}
+
+	// A reply ends the backoff
+	l.answered(ip)
+	if _, err := l.reserveQuery(ip, 100, time.Second); err != nil {
+		t.Errorf("query after a reply: %v", err)
+	}
+	l.unanswered(ip)
+	if b := backoff(); b > queryBackoffBase {
+		t.Errorf("backoff after a reply and a timeout %v, want %v", b, queryBackoffBase)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter()
+	idle, backingOff := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	l.reserveQuery(idle, 100, 0)
+	l.unanswered(backingOff)
+	for _, lim := range l.ips {
+		lim.lastUsed = time.Now().Add(-time.Hour)
+	}
+	l.prune(time.Minute)
+	if _, ok := l.ips[idle.String()]; ok {
+		t.Error("idle IP not pruned")
+	}
+	if _, ok := l.ips[backingOff.String()]; !ok {
+		t.Error("IP backing off was pruned")
+	}
+}
@@ -0,0 +1,342 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Responder configuration
+const (
+	tokenRotateInterval    = 5 * time.Minute
+	announcedPeerTTL       = 30 * time.Minute
+	maxPeersPerInfohash    = 100
+	maxAnnouncedInfohashes = 10000
+	maxSamplesPerResponse  = 20
+	sampleInterval         = 5 * time.Minute
+)
+
+// IncomingQuery is any KRPC query received from another node. The argument
+// struct is the union of the arguments of every query we answer.
+type IncomingQuery struct {
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+	Q string `bencode:"q"`
+	A struct {
+		ID          string   `bencode:"id"`
+		Target      string   `bencode:"target"`
+		InfoHash    string   `bencode:"info_hash"`
+		Port        int      `bencode:"port"`
+		ImpliedPort int      `bencode:"implied_port"`
+		Token       string   `bencode:"token"`
+		Want        []string `bencode:"want"`
+	} `bencode:"a"`
+}
+
+// ErrorResp is a KRPC error reply
+type ErrorResp struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	E []interface{} `bencode:"e"`
+}
+
+// tokenManager issues announce tokens bound to the requester's IP. The
+// secret rotates every tokenRotateInterval and tokens from the previous
+// secret are still accepted, so a token is valid for up to two intervals.
+type tokenManager struct {
+	mu       sync.Mutex
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+var tokens = &tokenManager{}
+
+func (tm *tokenManager) rotate() {
+	now := time.Now()
+	if tm.current != nil && now.Sub(tm.rotated) < tokenRotateInterval {
+		return
+	}
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	tm.previous, tm.current = tm.current, secret
+	tm.rotated = now
+}
+
+func tokenFor(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(ip)
+	h.Write(secret)
+	return string(h.Sum(nil)[:8])
+}
+
+func (tm *tokenManager) token(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate()
+	return tokenFor(tm.current, ip)
+}
+
+func (tm *tokenManager) valid(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate()
+	if token == tokenFor(tm.current, ip) {
+		return true
+	}
+	return tm.previous != nil && token == tokenFor(tm.previous, ip)
+}
+
+// peerStore keeps the peers announced to us, per raw infohash
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[string]map[string]time.Time
+}
+
+var announcedPeers = &peerStore{peers: make(map[string]map[string]time.Time)}
+
+func (ps *peerStore) add(infohash, address string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	peers, ok := ps.peers[infohash]
+	if !ok {
+		if len(ps.peers) >= maxAnnouncedInfohashes {
+			ps.expire()
+			if len(ps.peers) >= maxAnnouncedInfohashes {
+				return
+			}
+		}
+		peers = make(map[string]time.Time)
+		ps.peers[infohash] = peers
+	}
+	if _, ok := peers[address]; !ok && len(peers) >= maxPeersPerInfohash {
+		return
+	}
+	peers[address] = time.Now()
+}
+
+// expire drops announcements older than announcedPeerTTL. Callers hold ps.mu.
+func (ps *peerStore) expire() {
+	now := time.Now()
+	for infohash, peers := range ps.peers {
+		for address, seen := range peers {
+			if now.Sub(seen) > announcedPeerTTL {
+				delete(peers, address)
+			}
+		}
+		if len(peers) == 0 {
+			delete(ps.peers, infohash)
+		}
+	}
+}
+
+// values returns the compact peer info of live peers for an infohash in
+// the requested address family
+func (ps *peerStore) values(infohash string, ipv6 bool) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	var values []string
+	for address, seen := range ps.peers[infohash] {
+		if now.Sub(seen) > announcedPeerTTL {
+			continue
+		}
+		if peer, ok := encodeCompactPeer(address); ok && (len(peer) == 18) == ipv6 {
+			values = append(values, peer)
+		}
+	}
+	return values
+}
+
+// sampleCache holds the infohashes we hand out to sample_infohashes
+// queries, re-sampled from the Metadata bucket every sampleInterval.
+type sampleCache struct {
+	mu      sync.Mutex
+	samples string
+	num     int
+	updated time.Time
+}
+
+var ownSamples = &sampleCache{}
+
+func (sc *sampleCache) get() (string, int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.updated.IsZero() && time.Since(sc.updated) < sampleInterval {
+		return sc.samples, sc.num
+	}
+	sc.updated = time.Now()
+	if db == nil {
+		return sc.samples, sc.num
+	}
+
+	// Reservoir sample the stored infohashes
+	var picked [][]byte
+	num := 0
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Metadata"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			raw, err := hex.DecodeString(string(k))
+			if err != nil || len(raw) != 20 {
+				return nil
+			}
+			num++
+			if len(picked) < maxSamplesPerResponse {
+				picked = append(picked, raw)
+			} else if i := mrand.Intn(num); i < maxSamplesPerResponse {
+				picked[i] = raw
+			}
+			return nil
+		})
+	})
+	sc.samples = string(bytes.Join(picked, nil))
+	sc.num = num
+	return sc.samples, sc.num
+}
+
+// handleQuery answers a query received on the KRPC socket
+func (t *krpcTransport) handleQuery(from *net.UDPAddr, packet []byte) {
+	var query IncomingQuery
+	if err := decodeBencode(packet, &query); err != nil {
+		return
+	}
+	id, ok := nodeIDFromString(query.A.ID)
+	if !ok {
+		t.sendError(from, query.T, KRPCProtocolError, "invalid id")
+		return
+	}
+	tableFor(from.IP).Touch(id, from.String())
+	wantV4, wantV6 := wantedFamilies(query.A.Want, from)
+
+	switch query.Q {
+	case "ping":
+		resp := PingResp{T: query.T, Y: "r"}
+		resp.R.ID = localID().raw()
+		t.send(from, resp)
+
+	case "find_node":
+		target, ok := nodeIDFromString(query.A.Target)
+		if !ok {
+			t.sendError(from, query.T, KRPCProtocolError, "invalid target")
+			return
+		}
+		resp := FindNodeResp{T: query.T, Y: "r"}
+		resp.R.ID = localID().raw()
+		resp.R.Nodes, resp.R.Nodes6 = closestCompactNodes(target, wantV4, wantV6)
+		t.send(from, resp)
+
+	case "get_peers":
+		infohash, ok := nodeIDFromString(query.A.InfoHash)
+		if !ok {
+			t.sendError(from, query.T, KRPCProtocolError, "invalid info_hash")
+			return
+		}
+		harvest(infohash.String(), "", sourceGetPeers)
+		resp := GetPeersResp{T: query.T, Y: "r"}
+		resp.R.ID = localID().raw()
+		resp.R.Token = tokens.token(from.IP)
+		resp.R.Values = announcedPeers.values(infohash.raw(), from.IP.To4() == nil)
+		if len(resp.R.Values) == 0 {
+			resp.R.Nodes, resp.R.Nodes6 = closestCompactNodes(infohash, wantV4, wantV6)
+		}
+		t.send(from, resp)
+
+	case "announce_peer":
+		infohash, ok := nodeIDFromString(query.A.InfoHash)
+		if !ok {
+			t.sendError(from, query.T, KRPCProtocolError, "invalid info_hash")
+			return
+		}
+		if !tokens.valid(query.A.Token, from.IP) {
+			t.sendError(from, query.T, KRPCProtocolError, "bad token")
+			return
+		}
+		port := query.A.Port
+		if query.A.ImpliedPort != 0 {
+			port = from.Port
+		}
+		if port <= 0 || port > 65535 {
+			t.sendError(from, query.T, KRPCProtocolError, "invalid port")
+			return
+		}
+		peer := net.JoinHostPort(from.IP.String(), strconv.Itoa(port))
+		announcedPeers.add(infohash.raw(), peer)
+		harvest(infohash.String(), peer, sourceAnnouncePeer)
+		resp := PingResp{T: query.T, Y: "r"}
+		resp.R.ID = localID().raw()
+		t.send(from, resp)
+
+	case "sample_infohashes":
+		target, ok := nodeIDFromString(query.A.Target)
+		if !ok {
+			t.sendError(from, query.T, KRPCProtocolError, "invalid target")
+			return
+		}
+		resp := SampleInfohashResp{T: query.T, Y: "r"}
+		resp.R.ID = localID().raw()
+		resp.R.Interval = int(sampleInterval / time.Second)
+		resp.R.Nodes, resp.R.Nodes6 = closestCompactNodes(target, wantV4, wantV6)
+		resp.R.Samples, resp.R.Num = ownSamples.get()
+		t.send(from, resp)
+
+	default:
+		t.sendError(from, query.T, KRPCMethodUnknown, "method unknown")
+	}
+}
+
+// wantedFamilies decides which of nodes and nodes6 to return. Without a
+// "want" argument the requester's own address family is used (BEP 32).
+func wantedFamilies(want []string, from *net.UDPAddr) (bool, bool) {
+	if len(want) == 0 {
+		v4 := from.IP.To4() != nil
+		return v4, !v4
+	}
+	var v4, v6 bool
+	for _, w := range want {
+		switch w {
+		case "n4":
+			v4 = true
+		case "n6":
+			v6 = true
+		}
+	}
+	return v4, v6
+}
+
+// closestCompactNodes returns the compact node info of the bucketSize
+// nodes closest to target from the IPv4 and IPv6 routing tables
+func closestCompactNodes(target NodeID, v4, v6 bool) (string, string) {
+	var nodes, nodes6 string
+	if v4 {
+		nodes = compactNodes(routingTable.Closest(target, bucketSize))
+	}
+	if v6 {
+		nodes6 = compactNodes(routingTable6.Closest(target, bucketSize))
+	}
+	return nodes, nodes6
+}
+
+func compactNodes(nodes []Node) string {
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		if compact, ok := encodeCompactNode(node); ok {
+			buf.WriteString(compact)
+		}
+	}
+	return buf.String()
+}
+
+func (t *krpcTransport) sendError(to *net.UDPAddr, tid string, code int, message string) {
+	t.send(to, ErrorResp{T: tid, Y: "e", E: []interface{}{code, message}})
+}
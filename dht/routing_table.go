@@ -0,0 +1,392 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Routing table configuration (BEP 5)
+const (
+	nodeIDLength          = 20
+	bucketSize            = 8
+	goodNodeWindow        = 15 * time.Minute
+	bucketRefreshInterval = 15 * time.Minute
+	maxNodeFailures       = 3
+)
+
+// NodeID is a 160-bit DHT node identifier
+type NodeID [nodeIDLength]byte
+
+// nodeIDFromString converts a raw 20-byte string into a NodeID
+func nodeIDFromString(s string) (NodeID, bool) {
+	var id NodeID
+	if len(s) != nodeIDLength {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// randomNodeID returns a uniformly random NodeID
+func randomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// raw returns the 20-byte wire form of the ID
+func (id NodeID) raw() string {
+	return string(id[:])
+}
+
+// xor returns the Kademlia distance between two IDs
+func (id NodeID) xor(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// commonPrefixLen returns the number of leading bits shared by two IDs
+func (id NodeID) commonPrefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return nodeIDLength * 8
+}
+
+// closerTo reports whether id is closer to target than other is
+func (id NodeID) closerTo(target, other NodeID) bool {
+	a := id.xor(target)
+	b := other.xor(target)
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+type nodeState int
+
+const (
+	nodeGood nodeState = iota
+	nodeQuestionable
+	nodeBad
+)
+
+// The routing tables built around our node ID. IPv4 and IPv6 nodes are
+// kept in separate tables as BEP 32 requires.
+var (
+	routingTable  = NewRoutingTable(localID())
+	routingTable6 = NewRoutingTable(localID())
+)
+
+// tableFor returns the routing table for ip's address family
+func tableFor(ip net.IP) *RoutingTable {
+	if ip.To4() == nil {
+		return routingTable6
+	}
+	return routingTable
+}
+
+// tableForAddr returns the routing table for an IP:port address. Hostnames
+// are assumed to be IPv4.
+func tableForAddr(address string) *RoutingTable {
+	host, _, err := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); err == nil && ip != nil {
+		return tableFor(ip)
+	}
+	return routingTable
+}
+
+// closestNodes returns up to k nodes closest to target from both tables
+func closestNodes(target NodeID, k int) []Node {
+	nodes := append(routingTable.Closest(target, k), routingTable6.Closest(target, k)...)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID.closerTo(target, nodes[j].ID)
+	})
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// Node is an entry in the routing table
+type Node struct {
+	ID       NodeID
+	Addr     string
+	LastSeen time.Time
+	Failures int
+}
+
+// state classifies a node as good, questionable or bad per BEP 5
+func (n *Node) state(now time.Time) nodeState {
+	if n.Failures >= maxNodeFailures {
+		return nodeBad
+	}
+	if now.Sub(n.LastSeen) < goodNodeWindow {
+		return nodeGood
+	}
+	return nodeQuestionable
+}
+
+// kBucket holds up to bucketSize nodes, least recently seen first
+type kBucket struct {
+	nodes       []*Node
+	lastChanged time.Time
+}
+
+// RoutingTable is a Kademlia routing table indexed by the length of the
+// prefix a node ID shares with our own.
+type RoutingTable struct {
+	mu      sync.RWMutex
+	self    NodeID
+	buckets [nodeIDLength * 8]kBucket
+}
+
+// NewRoutingTable creates an empty routing table around our own ID
+func NewRoutingTable(self NodeID) *RoutingTable {
+	rt := &RoutingTable{self: self}
+	now := time.Now()
+	for i := range rt.buckets {
+		rt.buckets[i].lastChanged = now
+	}
+	return rt
+}
+
+// Rebase moves the table onto a new ID of our own, re-sorting every node
+// into the bucket it belongs in relative to it.
+func (rt *RoutingTable) Rebase(self NodeID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if self == rt.self {
+		return
+	}
+	var nodes []*Node
+	for i := range rt.buckets {
+		nodes = append(nodes, rt.buckets[i].nodes...)
+		rt.buckets[i].nodes = nil
+	}
+	rt.self = self
+	for _, n := range nodes {
+		if b := rt.bucketFor(n.ID); b != nil && len(b.nodes) < bucketSize {
+			b.nodes = append(b.nodes, n)
+		}
+	}
+}
+
+// bucketFor returns the bucket an ID belongs in, or nil for our own ID
+func (rt *RoutingTable) bucketFor(id NodeID) *kBucket {
+	i := rt.self.commonPrefixLen(id)
+	if i >= len(rt.buckets) {
+		return nil
+	}
+	return &rt.buckets[i]
+}
+
+// Insert records a node that has just responded to us. Known nodes are
+// refreshed and moved to the tail of their bucket; new nodes are added if
+// there is room or a bad node can be evicted. It reports whether the node
+// is in the table afterwards.
+func (rt *RoutingTable) Insert(id NodeID, addr string) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucketFor(id)
+	if b == nil {
+		return false
+	}
+	now := time.Now()
+
+	for i, n := range b.nodes {
+		if n.ID == id {
+			n.Addr = addr
+			n.LastSeen = now
+			n.Failures = 0
+			b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), n)
+			b.lastChanged = now
+			return true
+		}
+	}
+
+	node := &Node{ID: id, Addr: addr, LastSeen: now}
+	if len(b.nodes) < bucketSize {
+		b.nodes = append(b.nodes, node)
+		b.lastChanged = now
+		return true
+	}
+	for i, n := range b.nodes {
+		if n.state(now) == nodeBad {
+			b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), node)
+			b.lastChanged = now
+			return true
+		}
+	}
+	return false
+}
+
+// Restore adds a node loaded from disk, keeping its recorded state. It is
+// only added if its bucket has room.
+func (rt *RoutingTable) Restore(node Node) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	b := rt.bucketFor(node.ID)
+	if b == nil || len(b.nodes) >= bucketSize {
+		return
+	}
+	for _, n := range b.nodes {
+		if n.ID == node.ID {
+			return
+		}
+	}
+	restored := node
+	b.nodes = append(b.nodes, &restored)
+}
+
+// Nodes returns a copy of every node in the table
+func (rt *RoutingTable) Nodes() []Node {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	var nodes []Node
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			nodes = append(nodes, *n)
+		}
+	}
+	return nodes
+}
+
+// Touch refreshes a node already in the table that has sent us a query
+func (rt *RoutingTable) Touch(id NodeID, addr string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	b := rt.bucketFor(id)
+	if b == nil {
+		return
+	}
+	for _, n := range b.nodes {
+		if n.ID == id && n.Addr == addr {
+			n.LastSeen = time.Now()
+			return
+		}
+	}
+}
+
+// MarkFailure records a query to addr that went unanswered
+func (rt *RoutingTable) MarkFailure(addr string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			if n.Addr == addr {
+				n.Failures++
+				return
+			}
+		}
+	}
+}
+
+// Lookup returns the state of the node at addr, if it is in the table
+func (rt *RoutingTable) Lookup(addr string) (Node, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			if n.Addr == addr {
+				return *n, true
+			}
+		}
+	}
+	return Node{}, false
+}
+
+// Closest returns up to k non-bad nodes ordered by XOR distance to target
+func (rt *RoutingTable) Closest(target NodeID, k int) []Node {
+	rt.mu.RLock()
+	now := time.Now()
+	var nodes []Node
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			if n.state(now) != nodeBad {
+				nodes = append(nodes, *n)
+			}
+		}
+	}
+	rt.mu.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID.closerTo(target, nodes[j].ID)
+	})
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// Questionable returns the nodes that have not been heard from recently
+func (rt *RoutingTable) Questionable() []Node {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	now := time.Now()
+	var nodes []Node
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			if n.state(now) == nodeQuestionable {
+				nodes = append(nodes, *n)
+			}
+		}
+	}
+	return nodes
+}
+
+// StaleBuckets returns a random target inside every non-empty bucket that
+// has not changed within bucketRefreshInterval.
+func (rt *RoutingTable) StaleBuckets() []NodeID {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	now := time.Now()
+	var targets []NodeID
+	for i := range rt.buckets {
+		b := &rt.buckets[i]
+		if len(b.nodes) == 0 || now.Sub(b.lastChanged) < bucketRefreshInterval {
+			continue
+		}
+		targets = append(targets, rt.randomIDInBucket(i))
+		b.lastChanged = now
+	}
+	return targets
+}
+
+// randomIDInBucket returns an ID sharing exactly i prefix bits with ours
+func (rt *RoutingTable) randomIDInBucket(i int) NodeID {
+	id := randomNodeID()
+	for bit := 0; bit <= i && bit < nodeIDLength*8; bit++ {
+		mask := byte(0x80 >> (bit % 8))
+		want := rt.self[bit/8] & mask
+		if bit == i {
+			want ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | want
+	}
+	return id
+}
+
+// Len returns the number of nodes in the table
+func (rt *RoutingTable) Len() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	n := 0
+	for i := range rt.buckets {
+		n += len(rt.buckets[i].nodes)
+	}
+	return n
+}
@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testAddr(i int) string {
+	return fmt.Sprintf("10.0.%d.%d:6881", i>>8, i&0xff)
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := NewRoutingTable(randomNodeID())
+	var nodes []Node
+	for i := 0; i < 25*bucketSize; i++ {
+		id := rt.randomIDInBucket(i / bucketSize)
+		if !rt.Insert(id, testAddr(i)) {
+			t.Fatalf("Insert into a bucket with room failed")
+		}
+		nodes = append(nodes, Node{ID: id, Addr: testAddr(i)})
+	}
+	bad := nodes[0]
+	for i := 0; i < maxNodeFailures; i++ {
+		rt.MarkFailure(bad.Addr)
+	}
+
+	target := randomNodeID()
+	got := rt.Closest(target, lookupK)
+	want := closestTo(target, nodes[1:])
+	if len(got) != len(want) {
+		t.Fatalf("Closest returned %d nodes, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			t.Errorf("Closest[%d] = %s, want %s", i, got[i].ID, want[i].ID)
+		}
+	}
+	// A bad node is never returned, however close it is
+	for _, n := range rt.Closest(bad.ID, lookupK) {
+		if n.Addr == bad.Addr {
+			t.Errorf("Closest returned the bad node %s", bad.Addr)
+		}
+	}
+}
+
+func TestRoutingTableEviction(t *testing.T) {
+	rt := NewRoutingTable(randomNodeID())
+	for i := 0; i < bucketSize; i++ {
+		if !rt.Insert(rt.randomIDInBucket(5), testAddr(i)) {
+			t.Fatalf("Insert into a bucket with room failed")
+		}
+	}
+
+	extra := rt.randomIDInBucket(5)
+	if rt.Insert(extra, testAddr(bucketSize)) {
+		t.Fatal("Insert into a full bucket of good nodes succeeded")
+	}
+	// A questionable node is not evicted
+	rt.buckets[5].nodes[0].LastSeen = time.Now().Add(-2 * goodNodeWindow)
+	if rt.Insert(extra, testAddr(bucketSize)) {
+		t.Fatal("Insert evicted a questionable node")
+	}
+
+	for i := 0; i < maxNodeFailures; i++ {
+		rt.MarkFailure(testAddr(3))
+	}
+	if !rt.Insert(extra, testAddr(bucketSize)) {
+		t.Fatal("Insert did not evict the bad node")
+	}
+	if _, ok := rt.Lookup(testAddr(3)); ok {
+		t.Error("bad node still in the table")
+	}
+	b := rt.buckets[5].nodes
+	if len(b) != bucketSize || b[len(b)-1].ID != extra {
+		t.Errorf("new node not at the tail of its bucket")
+	}
+}
+
+func TestRoutingTableNodeStates(t *testing.T) {
+	rt := NewRoutingTable(randomNodeID())
+	id := randomNodeID()
+	addr := testAddr(1)
+	rt.Insert(id, addr)
+	now := time.Now()
+
+	state := func() nodeState {
+		n, ok := rt.Lookup(addr)
+		if !ok {
+			t.Fatal("node missing from the table")
+		}
+		return n.state(now)
+	}
+	if s := state(); s != nodeGood {
+		t.Errorf("new node is %v, want good", s)
+	}
+
+	rt.buckets[rt.self.commonPrefixLen(id)].nodes[0].LastSeen = now.Add(-goodNodeWindow - time.Second)
+	if s := state(); s != nodeQuestionable {
+		t.Errorf("node not heard from is %v, want questionable", s)
+	}
+	if q := rt.Questionable(); len(q) != 1 || q[0].Addr != addr {
+		t.Errorf("Questionable() = %v", q)
+	}
+
+	for i := 0; i < maxNodeFailures; i++ {
+		if s := state(); s == nodeBad {
+			t.Fatalf("node bad after %d failures", i)
+		}
+		rt.MarkFailure(addr)
+	}
+	if s := state(); s != nodeBad {
+		t.Errorf("node is %v after %d failures, want bad", s, maxNodeFailures)
+	}
+	if len(rt.Questionable()) != 0 || len(rt.Closest(id, lookupK)) != 0 {
+		t.Error("bad node returned as questionable or closest")
+	}
+
+	// Hearing from the node again makes it good
+	rt.Insert(id, addr)
+	now = time.Now()
+	if s := state(); s != nodeGood {
+		t.Errorf("node is %v after responding, want good", s)
+	}
+}
+
+func TestRoutingTableRebase(t *testing.T) {
+	rt := NewRoutingTable(randomNodeID())
+	for i := 0; i < 10*bucketSize; i++ {
+		rt.Insert(rt.randomIDInBucket(i/bucketSize), testAddr(i))
+	}
+
+	// Flipping the first bit moves the old bucket 0 into the buckets past
+	// the new bucket 0, and every other node into the new bucket 0, which
+	// keeps bucketSize of them
+	self := rt.self
+	self[0] ^= 0x80
+	rt.Rebase(self)
+
+	if rt.self != self {
+		t.Fatal("Rebase did not change the table's ID")
+	}
+	for i := range rt.buckets {
+		if len(rt.buckets[i].nodes) > bucketSize {
+			t.Errorf("bucket %d holds %d nodes", i, len(rt.buckets[i].nodes))
+		}
+		for _, n := range rt.buckets[i].nodes {
+			if cpl := self.commonPrefixLen(n.ID); cpl != i {
+				t.Errorf("node with prefix %d in bucket %d", cpl, i)
+			}
+		}
+	}
+	if n := rt.Len(); n != 2*bucketSize {
+		t.Errorf("%d nodes after Rebase, want %d", n, 2*bucketSize)
+	}
+}
@@ -1,22 +1,23 @@
 package dht
 
 import (
-	"bytes"
-	"context"
+	"errors"
 	"fmt"
-	"net"
-	"time"
-
-	"github.com/jackpal/bencode-go"
 )
 
+// errNoSamples is returned for replies to sample_infohashes that carry none
+// of BEP 51's fields, which some nodes that do not implement it send instead
+// of a method unknown error
+var errNoSamples = errors.New("response has no BEP 51 fields")
+
 type SampleInfohashReq struct {
 	T string `bencode:"t"`
 	Y string `bencode:"y"`
 	Q string `bencode:"q"`
 	A struct {
-		ID     string `bencode:"id"`
-		Target string `bencode:"target"`
+		ID     string   `bencode:"id"`
+		Target string   `bencode:"target"`
+		Want   []string `bencode:"want,omitempty"` // Address families wanted (BEP 32)
 	} `bencode:"a"`
 }
 
@@ -24,7 +25,8 @@ type SampleInfohashResp struct {
 	R struct {
 		ID       string `bencode:"id"`      // 20-byte peer ID
 		Interval int    `bencode:"interval"` // int for interval
-		Nodes    string `bencode:"nodes"`   // Binary compact node info (string)
+		Nodes    string `bencode:"nodes,omitempty"`  // Binary compact node info (string)
+		Nodes6   string `bencode:"nodes6,omitempty"` // Binary compact IPv6 node info (string)
 		Num      int    `bencode:"num"`     // int for number of nodes/samples
 		Samples  string `bencode:"samples"` // Binary compact sample info (string)
 	} `bencode:"r"`
@@ -32,54 +34,53 @@ type SampleInfohashResp struct {
 	Y string `bencode:"y"`
 }
 
-func sendSampleInfohashRequest(nodeID, address, target string) ([]string, error) {
-	// Create the request
-	req := SampleInfohashReq{T: "aa", Y: "q", Q: "sample_infohashes"}
-	req.A.ID = nodeID
-	req.A.Target = target
+func (r *SampleInfohashReq) setTransactionID(t string) { r.T = t }
 
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, req)
+func sendSampleInfohashRequest(nodeID, address, target string) (*SampleInfohashResp, error) {
+	t, err := getTransport()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal sample_infohashes request: %v", err)
+		return nil, err
 	}
 
-	// Create UDP connection
-	var d net.Dialer
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	conn, err := d.DialContext(ctx, "udp4", address)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial: %v", err)
-	}
-	defer conn.Close()
-
-	// Send request
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		return nil, fmt.Errorf("failed to send sample_infohashes request: %v", err)
-	}
+	// Create the request
+	req := SampleInfohashReq{Y: "q", Q: "sample_infohashes"}
+	req.A.ID = nodeID
+	req.A.Target = target
+	req.A.Want = t.want()
 
-	// Read response
-	resp := make([]byte, 65535)
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	n, err := conn.Read(resp)
+	// Send request and wait for the matching response
+	resp, err := t.query(address, &req, requestTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, fmt.Errorf("sample_infohashes request failed: %w", err)
 	}
-	resp = resp[:n] // Trim the response to actual size
-	// fmt.Printf("Response from %s: %x\n", address, resp) // Print raw response in hex format
 
 	// Unmarshal response
 	var response SampleInfohashResp
-	r := bytes.NewReader(resp)
-	err = bencode.Unmarshal(r, &response)
+	err = decodeBencode(resp, &response)
 	if err != nil {
+		autoBanAddr(address)
 		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
+	if !hasSampleFields(resp) {
+		return nil, fmt.Errorf("sample_infohashes response from %s: %w", address, errNoSamples)
+	}
 
-	// Parse and return the infohashes (if available)
-	infohashes := parseInfohashes([]byte(response.R.Samples)) // Assuming it's compact node format
-	return infohashes, nil
+	return &response, nil
+}
+
+// hasSampleFields reports whether a sample_infohashes response carries an
+// integer interval or a string of samples. An empty sample from a node that
+// stores no infohashes still counts.
+func hasSampleFields(resp []byte) bool {
+	r, err := bencodeDictValue(resp, "r")
+	if err != nil || r == nil {
+		return false
+	}
+	if interval, err := bencodeDictValue(r, "interval"); err == nil && len(interval) > 0 && interval[0] == 'i' {
+		return true
+	}
+	samples, err := bencodeDictValue(r, "samples")
+	return err == nil && len(samples) > 0 && samples[0] >= '0' && samples[0] <= '9'
 }
 
 // Function to parse infohashes from the samples field
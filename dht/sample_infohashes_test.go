@@ -0,0 +1,22 @@
+package dht
+
+import "testing"
+
+func TestHasSampleFields(t *testing.T) {
+	tests := []struct {
+		resp string
+		want bool
+	}{
+		{"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa8:intervali0e3:numi0e7:samples0:e1:t2:aa1:y1:re", true},
+		{"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa7:samples20:bbbbbbbbbbbbbbbbbbbbe1:t2:aa1:y1:re", true},
+		{"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa8:intervali21600ee1:t2:aa1:y1:re", true},
+		{"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes0:e1:t2:aa1:y1:re", false},
+		{"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa8:interval1:x7:samplesi0ee1:t2:aa1:y1:re", false},
+		{"d1:t2:aa1:y1:re", false},
+	}
+	for _, tt := range tests {
+		if got := hasSampleFields([]byte(tt.resp)); got != tt.want {
+			t.Errorf("hasSampleFields(%q) = %v, want %v", tt.resp, got, tt.want)
+		}
+	}
+}
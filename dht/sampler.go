@@ -0,0 +1,285 @@
+package dht
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sampler configuration (BEP 51)
+const (
+	samplerWorkers       = 20
+	maxSamplerNodes      = 50000
+	keyspaceSlices       = 256 // Targets walk the keyspace one first byte at a time
+	defaultSampleWait    = 5 * time.Minute
+	maxSampleWait        = 6 * time.Hour // BEP 51 caps interval at 21600 seconds
+	samplerRetryWait     = 10 * time.Minute
+	maxSamplerFailures   = 3
+	samplerSchedulerTick = time.Second
+	bep51SupportTTL      = 6 * time.Hour // How long support is remembered for nodes no longer sampled
+	maxBEP51Entries      = 200000
+)
+
+// sampleNode is a node we periodically sample infohashes from
+type sampleNode struct {
+	addr       string
+	nextSample time.Time
+	nextSlice  int // Keyspace slice the next target is drawn from
+	queries    int
+	samples    int // Infohashes returned in total
+	newHashes  int // Infohashes returned that we had not seen before
+	failures   int
+	index      int // Position in the schedule heap, -1 when not scheduled
+}
+
+// yield is the number of new infohashes a node has produced per query. Nodes
+// never sampled get a neutral prior so they are tried.
+func (n *sampleNode) yield() float64 {
+	return float64(n.newHashes+1) / float64(n.queries+1)
+}
+
+// sampleSchedule is a min-heap of nodes ordered by when they may be sampled
+type sampleSchedule []*sampleNode
+
+func (s sampleSchedule) Len() int           { return len(s) }
+func (s sampleSchedule) Less(i, j int) bool { return s[i].nextSample.Before(s[j].nextSample) }
+func (s sampleSchedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].index = i
+	s[j].index = j
+}
+func (s *sampleSchedule) Push(x interface{}) {
+	n := x.(*sampleNode)
+	n.index = len(*s)
+	*s = append(*s, n)
+}
+func (s *sampleSchedule) Pop() interface{} {
+	old := *s
+	n := old[len(old)-1]
+	old[len(old)-1] = nil
+	n.index = -1
+	*s = old[:len(old)-1]
+	return n
+}
+
+// infohashSampler schedules sample_infohashes queries so that each node is
+// asked no more often than its advertised interval, prefers nodes that have
+// yielded the most new infohashes, and follows returned nodes to discover
+// more BEP 51 capable nodes.
+type infohashSampler struct {
+	mu       sync.Mutex
+	nodes    map[string]*sampleNode
+	schedule sampleSchedule
+	bep51    map[string]bep51Status
+}
+
+// bep51Status records whether a node is known to implement BEP 51
+type bep51Status struct {
+	supported bool
+	checked   time.Time
+}
+
+var sampler = &infohashSampler{
+	nodes: make(map[string]*sampleNode),
+	bep51: make(map[string]bep51Status),
+}
+
+// add registers a node for sampling. Known nodes are left as scheduled and
+// nodes known not to implement BEP 51 are ignored.
+func (s *infohashSampler) add(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, known := s.bep51[address]; known && !status.supported {
+		return
+	}
+	if _, ok := s.nodes[address]; ok || len(s.nodes) >= maxSamplerNodes {
+		return
+	}
+	n := &sampleNode{
+		addr:       address,
+		nextSample: time.Now(),
+		nextSlice:  rand.Intn(keyspaceSlices),
+	}
+	s.nodes[address] = n
+	heap.Push(&s.schedule, n)
+}
+
+// setSupport records whether a node implements BEP 51. Once maxBEP51Entries
+// nodes are known, only new nodes that support it are recorded.
+func (s *infohashSampler) setSupport(address string, supported bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, known := s.bep51[address]; !known && !supported && len(s.bep51) >= maxBEP51Entries {
+		return
+	}
+	s.bep51[address] = bep51Status{supported: supported, checked: time.Now()}
+}
+
+// support reports whether a node implements BEP 51, if known
+func (s *infohashSampler) support(address string) (supported, known bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, known := s.bep51[address]
+	return status.supported, known
+}
+
+// pruneSupport forgets the BEP 51 support of nodes that are not being
+// sampled and were last checked more than bep51SupportTTL ago, so that
+// nodes seen once on a long crawl do not stay in memory for good.
+func (s *infohashSampler) pruneSupport() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for address, status := range s.bep51 {
+		if _, sampling := s.nodes[address]; !sampling && now.Sub(status.checked) > bep51SupportTTL {
+			delete(s.bep51, address)
+		}
+	}
+}
+
+// supportedNodes returns the addresses of nodes known to implement BEP 51
+func (s *infohashSampler) supportedNodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addresses []string
+	for address, status := range s.bep51 {
+		if status.supported {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// remove stops sampling a node
+func (s *infohashSampler) remove(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[address]
+	if !ok {
+		return
+	}
+	delete(s.nodes, address)
+	if n.index >= 0 {
+		heap.Remove(&s.schedule, n.index)
+	}
+}
+
+// ready pops up to max nodes whose interval has elapsed, most productive
+// first. Ready nodes that are not picked stay scheduled.
+func (s *infohashSampler) ready(max int) []*sampleNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var due []*sampleNode
+	for s.schedule.Len() > 0 && !s.schedule[0].nextSample.After(now) {
+		due = append(due, heap.Pop(&s.schedule).(*sampleNode))
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].yield() > due[j].yield()
+	})
+	if len(due) > max {
+		for _, n := range due[max:] {
+			heap.Push(&s.schedule, n)
+		}
+		due = due[:max]
+	}
+	return due
+}
+
+// nextTarget returns a random target in the node's next keyspace slice
+func (s *infohashSampler) nextTarget(n *sampleNode) NodeID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := randomNodeID()
+	target[0] = byte(n.nextSlice * 256 / keyspaceSlices)
+	n.nextSlice = (n.nextSlice + 1) % keyspaceSlices
+	return target
+}
+
+// reschedule records the outcome of a sample and puts the node back on the
+// schedule, or drops it once it has failed too often.
+func (s *infohashSampler) reschedule(n *sampleNode, wait time.Duration, samples, newHashes int, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The node may have been removed, and perhaps added again as a new
+	// entry, while its sample was in flight
+	if s.nodes[n.addr] != n {
+		return
+	}
+	if failed {
+		n.failures++
+		if n.failures >= maxSamplerFailures {
+			delete(s.nodes, n.addr)
+			return
+		}
+	} else {
+		n.failures = 0
+		n.queries++
+		n.samples += samples
+		n.newHashes += newHashes
+	}
+	n.nextSample = time.Now().Add(wait)
+	heap.Push(&s.schedule, n)
+}
+
+// run dispatches sample queries until ctx is cancelled
+func (s *infohashSampler) run(ctx context.Context) {
+	workers := make(chan struct{}, samplerWorkers)
+	ticker := time.NewTicker(samplerSchedulerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, n := range s.ready(cap(workers) - len(workers)) {
+			workers <- struct{}{}
+			go func(n *sampleNode) {
+				defer func() { <-workers }()
+				s.sample(n)
+			}(n)
+		}
+	}
+}
+
+// sample queries one node and feeds what it returns back into the crawler
+func (s *infohashSampler) sample(n *sampleNode) {
+	target := s.nextTarget(n)
+	resp, err := sendSampleInfohashRequest(localID().raw(), n.addr, target.raw())
+	if isKRPCError(err, KRPCMethodUnknown) || errors.Is(err, errNoSamples) {
+		s.setSupport(n.addr, false)
+		s.remove(n.addr)
+		return
+	}
+	if err != nil {
+		s.reschedule(n, samplerRetryWait, 0, 0, true)
+		return
+	}
+	s.setSupport(n.addr, true)
+
+	infohashes := parseInfohashes([]byte(resp.R.Samples))
+	newHashes := 0
+	for _, infohash := range infohashes {
+		if harvest(infohash, "", sourceSampleInfohashes) {
+			newHashes++
+		}
+	}
+
+	// Follow the returned nodes to find more nodes to sample
+	for _, node := range append(parseCompactNodes(resp.R.Nodes), parseCompactNodes6(resp.R.Nodes6)...) {
+		s.add(node.Addr)
+	}
+
+	wait := time.Duration(resp.R.Interval) * time.Second
+	if wait <= 0 {
+		wait = defaultSampleWait
+	} else if wait > maxSampleWait {
+		wait = maxSampleWait
+	}
+	s.reschedule(n, wait, len(infohashes), newHashes, false)
+}
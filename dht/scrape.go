@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"math"
+	"math/bits"
+)
+
+// BEP 33 bloom filter parameters
+const (
+	bloomFilterBytes  = 256
+	bloomFilterBits   = bloomFilterBytes * 8
+	bloomFilterHashes = 2
+)
+
+// bloomFilter is a BEP 33 scrape filter of the IPs of a torrent's seeders
+// (BFsd) or downloaders (BFpe)
+type bloomFilter [bloomFilterBytes]byte
+
+// merge ORs a filter from a get_peers response into f, reporting whether
+// it was well formed. Filters from different nodes combine this way into a
+// filter of all the IPs any of them knows.
+func (f *bloomFilter) merge(filter string) bool {
+	if len(filter) != bloomFilterBytes {
+		return false
+	}
+	for i := range f {
+		f[i] |= filter[i]
+	}
+	return true
+}
+
+// estimate returns the number of distinct IPs the filter holds
+func (f *bloomFilter) estimate() int {
+	zeros := 0
+	for _, b := range f {
+		zeros += 8 - bits.OnesCount8(b)
+	}
+	if zeros == 0 {
+		zeros = 1 // A saturated filter only tells us the swarm is large
+	}
+	m := float64(bloomFilterBits)
+	size := math.Log(float64(zeros)/m) / (bloomFilterHashes * math.Log(1-1/m))
+	return int(math.Round(size))
+}
+
+// scrapeResult accumulates the BEP 33 filters returned during a lookup
+type scrapeResult struct {
+	seeders   bloomFilter
+	leechers  bloomFilter
+	responses int // Responses carrying well-formed filters
+}
+
+// add merges the filters from one get_peers response
+func (s *scrapeResult) add(seeders, leechers string) {
+	okSeeders := s.seeders.merge(seeders)
+	okLeechers := s.leechers.merge(leechers)
+	if okSeeders || okLeechers {
+		s.responses++
+	}
+}
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+)
+
+// insertIP adds ip to f the way BEP 33 nodes build their filters
+func insertIP(f *bloomFilter, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hash := sha1.Sum(ip)
+	for _, index := range []int{int(hash[0]) | int(hash[1])<<8, int(hash[2]) | int(hash[3])<<8} {
+		index %= bloomFilterBits
+		f[index/8] |= 1 << (index % 8)
+	}
+}
+
+// The BEP 33 example: 192.0.2.0-192.0.2.255 and 2001:db8::-2001:db8::3e7
+// give an estimate of 1224.93
+func TestBloomFilterEstimate(t *testing.T) {
+	var f bloomFilter
+	for i := 0; i < 256; i++ {
+		insertIP(&f, net.IPv4(192, 0, 2, byte(i)))
+	}
+	base := new(big.Int).SetBytes(net.ParseIP("2001:db8::"))
+	for i := 0; i < 1000; i++ {
+		ip := new(big.Int).Add(base, big.NewInt(int64(i))).Bytes()
+		insertIP(&f, net.IP(ip))
+	}
+	if got := f.estimate(); got != 1225 {
+		t.Errorf("estimate() = %d, want 1225", got)
+	}
+
+	var empty bloomFilter
+	if got := empty.estimate(); got != 0 {
+		t.Errorf("estimate() of an empty filter = %d, want 0", got)
+	}
+
+	var full bloomFilter
+	full.merge(strings.Repeat("\xff", bloomFilterBytes))
+	if got := full.estimate(); got <= 0 {
+		t.Errorf("estimate() of a saturated filter = %d, want a large count", got)
+	}
+}
+
+func TestScrapeResultAdd(t *testing.T) {
+	var a, b bloomFilter
+	insertIP(&a, net.ParseIP("192.0.2.1"))
+	insertIP(&b, net.ParseIP("192.0.2.2"))
+
+	var s scrapeResult
+	s.add(string(a[:]), "")
+	s.add(string(b[:]), "too short")
+	s.add("", "")
+	if s.responses != 2 {
+		t.Errorf("responses = %d, want 2", s.responses)
+	}
+	if got := s.seeders.estimate(); got != 2 {
+		t.Errorf("merged seeders estimate = %d, want 2", got)
+	}
+	if got := s.leechers.estimate(); got != 0 {
+		t.Errorf("leechers estimate = %d, want 0", got)
+	}
+}
@@ -0,0 +1,456 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jackpal/bencode-go"
+)
+
+// Swarm persistence configuration
+const (
+	swarmBucketName    = "Swarm"
+	swarmFlushInterval = time.Minute
+	swarmSweepInterval = time.Hour
+	swarmRecordTTL     = 7 * 24 * time.Hour // Records of torrents without metadata are dropped after this
+	maxSwarmPeers      = 1000               // Peer addresses remembered per infohash
+	maxSwarmClients    = 50                 // Client strings remembered per infohash
+	maxPendingSwarms   = 50000              // Infohashes with unsaved observations
+)
+
+// swarmRecord is the on-disk form of what we know about a torrent's swarm
+type swarmRecord struct {
+	FirstSeen int64          `bencode:"first_seen"`
+	LastSeen  int64          `bencode:"last_seen"`
+	SeenCount int            `bencode:"seen_count"` // Times the infohash turned up on the DHT
+	PeerCount int            `bencode:"peer_count"` // Peers returned by the latest get_peers lookup
+	Peers     []string       `bencode:"peers"`      // Compact addresses of the distinct peers seen
+	Clients   map[string]int `bencode:"clients"`    // Connections per client string
+	Seeders   int            `bencode:"seeders"`    // BEP 33 estimates from the latest scrape
+	Leechers  int            `bencode:"leechers"`
+	ScrapedAt int64          `bencode:"scraped_at"`
+	UpdatedAt int64          `bencode:"updated_at"` // Last flush that changed the record
+}
+
+// SwarmStats is what the crawler has observed about a torrent's swarm
+type SwarmStats struct {
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	SeenCount   int
+	PeerCount   int // Peers returned by the latest get_peers lookup
+	UniquePeers int // Distinct peer addresses seen, up to maxSwarmPeers
+	UniqueIPs   int
+	Clients     map[string]int
+	Seeders     int // BEP 33 estimates from the latest scrape
+	Leechers    int
+	ScrapedAt   time.Time // Zero if the torrent was never scraped
+}
+
+// Popularity is the largest of the latest lookup's peer count, the distinct
+// peers seen and the scraped swarm size
+func (s SwarmStats) Popularity() int {
+	popularity := s.PeerCount
+	if s.UniquePeers > popularity {
+		popularity = s.UniquePeers
+	}
+	if s.Seeders+s.Leechers > popularity {
+		popularity = s.Seeders + s.Leechers
+	}
+	return popularity
+}
+
+// TopClients returns the client strings seen most often, most common first
+func (s SwarmStats) TopClients(n int) []string {
+	clients := make([]string, 0, len(s.Clients))
+	for client := range s.Clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if s.Clients[clients[i]] != s.Clients[clients[j]] {
+			return s.Clients[clients[i]] > s.Clients[clients[j]]
+		}
+		return clients[i] < clients[j]
+	})
+	if len(clients) > n {
+		clients = clients[:n]
+	}
+	return clients
+}
+
+// swarmUpdate collects the observations of one infohash between flushes
+type swarmUpdate struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	sightings int
+	peerCount int // -1 if no lookup finished
+	peers     []string
+	clients   map[string]int
+	scrapedAt time.Time // Zero if no scrape finished
+	seeders   int
+	leechers  int
+}
+
+// swarmTracker buffers swarm observations in memory so that the crawler's
+// hot paths do not write to the database
+type swarmTracker struct {
+	mu      sync.Mutex
+	pending map[string]*swarmUpdate
+}
+
+var swarms = &swarmTracker{pending: make(map[string]*swarmUpdate)}
+
+// update returns the pending update for infohash, or nil if too many
+// infohashes are waiting to be flushed. Callers hold s.mu.
+func (s *swarmTracker) update(infohash string) *swarmUpdate {
+	u, ok := s.pending[infohash]
+	if !ok {
+		if len(s.pending) >= maxPendingSwarms {
+			return nil
+		}
+		u = &swarmUpdate{peerCount: -1, clients: make(map[string]int)}
+		s.pending[infohash] = u
+	}
+	return u
+}
+
+// seen records that infohash turned up on the DHT
+func (s *swarmTracker) seen(infohash string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.update(infohash); u != nil {
+		if u.firstSeen.IsZero() {
+			u.firstSeen = now
+		}
+		u.lastSeen = now
+		u.sightings++
+	}
+}
+
+// addPeers records peers (ip:port) of infohash
+func (s *swarmTracker) addPeers(infohash string, peers ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.update(infohash); u != nil && len(u.peers) < maxSwarmPeers {
+		u.peers = append(u.peers, peers...)
+	}
+}
+
+// observeLookup records the peers a get_peers lookup for infohash returned
+func (s *swarmTracker) observeLookup(infohash string, peers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.update(infohash); u != nil {
+		u.peerCount = len(peers)
+		if len(u.peers) < maxSwarmPeers {
+			u.peers = append(u.peers, peers...)
+		}
+	}
+}
+
+// observeScrape records the BEP 33 estimates of a lookup for infohash
+func (s *swarmTracker) observeScrape(infohash string, seeders, leechers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.update(infohash); u != nil {
+		u.scrapedAt = time.Now()
+		u.seeders, u.leechers = seeders, leechers
+	}
+}
+
+// addClient records the client string of a peer serving infohash
+func (s *swarmTracker) addClient(infohash, client string) {
+	if client == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.update(infohash); u != nil {
+		u.clients[client]++
+	}
+}
+
+// merge applies an update to a stored record
+func (r *swarmRecord) merge(u *swarmUpdate, now time.Time) {
+	r.UpdatedAt = now.Unix()
+	if !u.firstSeen.IsZero() {
+		if r.FirstSeen == 0 || u.firstSeen.Unix() < r.FirstSeen {
+			r.FirstSeen = u.firstSeen.Unix()
+		}
+		if u.lastSeen.Unix() > r.LastSeen {
+			r.LastSeen = u.lastSeen.Unix()
+		}
+	}
+	r.SeenCount += u.sightings
+	if u.peerCount >= 0 {
+		r.PeerCount = u.peerCount
+	}
+	if !u.scrapedAt.IsZero() {
+		r.Seeders, r.Leechers = u.seeders, u.leechers
+		r.ScrapedAt = u.scrapedAt.Unix()
+	}
+
+	known := make(map[string]bool, len(r.Peers))
+	for _, peer := range r.Peers {
+		known[peer] = true
+	}
+	for _, peer := range u.peers {
+		compact, ok := encodeCompactPeer(peer)
+		if !ok || known[compact] || len(r.Peers) >= maxSwarmPeers {
+			continue
+		}
+		known[compact] = true
+		r.Peers = append(r.Peers, compact)
+	}
+
+	if r.Clients == nil {
+		r.Clients = make(map[string]int)
+	}
+	for client, n := range u.clients {
+		if _, ok := r.Clients[client]; ok || len(r.Clients) < maxSwarmClients {
+			r.Clients[client] += n
+		}
+	}
+}
+
+// absorb merges the record of another infohash of the same torrent
+func (r *swarmRecord) absorb(o swarmRecord) {
+	if o.FirstSeen != 0 && (r.FirstSeen == 0 || o.FirstSeen < r.FirstSeen) {
+		r.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen > r.LastSeen {
+		r.LastSeen = o.LastSeen
+	}
+	if o.UpdatedAt > r.UpdatedAt {
+		r.UpdatedAt = o.UpdatedAt
+	}
+	r.SeenCount += o.SeenCount
+	if o.PeerCount > r.PeerCount {
+		r.PeerCount = o.PeerCount
+	}
+	if o.ScrapedAt > r.ScrapedAt {
+		r.Seeders, r.Leechers = o.Seeders, o.Leechers
+		r.ScrapedAt = o.ScrapedAt
+	}
+
+	known := make(map[string]bool, len(r.Peers))
+	for _, peer := range r.Peers {
+		known[peer] = true
+	}
+	for _, peer := range o.Peers {
+		if known[peer] || len(r.Peers) >= maxSwarmPeers {
+			continue
+		}
+		known[peer] = true
+		r.Peers = append(r.Peers, peer)
+	}
+
+	if r.Clients == nil {
+		r.Clients = make(map[string]int)
+	}
+	for client, n := range o.Clients {
+		if _, ok := r.Clients[client]; ok || len(r.Clients) < maxSwarmClients {
+			r.Clients[client] += n
+		}
+	}
+}
+
+// putSwarmRecord writes the swarm record for infohash
+func putSwarmRecord(bucket *bolt.Bucket, infohash string, record swarmRecord) error {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, record); err != nil {
+		return err
+	}
+	return bucket.Put([]byte(infohash), buf.Bytes())
+}
+
+// mergeSwarmAliases moves the swarm records kept under the aliases of
+// infohash into its own record, for torrents seen on the DHT by their other
+// infohash before their metadata was stored
+func mergeSwarmAliases(tx *bolt.Tx, infohash string, aliases []string) error {
+	bucket := tx.Bucket([]byte(swarmBucketName))
+	if bucket == nil {
+		return nil
+	}
+	var merged *swarmRecord
+	for _, alias := range aliases {
+		if alias == infohash || bucket.Get([]byte(alias)) == nil {
+			continue
+		}
+		if merged == nil {
+			record := loadSwarmRecord(tx, infohash)
+			merged = &record
+		}
+		merged.absorb(loadSwarmRecord(tx, alias))
+		if err := bucket.Delete([]byte(alias)); err != nil {
+			return err
+		}
+	}
+	if merged == nil {
+		return nil
+	}
+	return putSwarmRecord(bucket, infohash, *merged)
+}
+
+// FlushSwarms writes the buffered swarm observations to the Swarm bucket,
+// under the infohash the torrent's metadata is stored under if it is an
+// alias
+func FlushSwarms() error {
+	if db == nil {
+		return fmt.Errorf("database not initialised")
+	}
+	swarms.mu.Lock()
+	pending := swarms.pending
+	swarms.pending = make(map[string]*swarmUpdate)
+	swarms.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(swarmBucketName))
+		if err != nil {
+			return fmt.Errorf("failed to create bucket: %v", err)
+		}
+		for infohash, u := range pending {
+			infohash = resolveInfohash(tx, infohash)
+			record := loadSwarmRecord(tx, infohash)
+			record.merge(u, now)
+			if err := putSwarmRecord(bucket, infohash, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SweepSwarms deletes the swarm records of torrents whose metadata is not
+// stored and that have not been seen or looked up for maxAge, so that the
+// Swarm bucket does not keep every infohash that ever turned up on the DHT
+func SweepSwarms(maxAge time.Duration) error {
+	if db == nil {
+		return fmt.Errorf("database not initialised")
+	}
+	cutoff := time.Now().Add(-maxAge).Unix()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(swarmBucketName))
+		if bucket == nil {
+			return nil
+		}
+		metadata := tx.Bucket([]byte("Metadata"))
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			if metadata != nil && metadata.Get([]byte(resolveInfohash(tx, string(k)))) != nil {
+				return nil
+			}
+			var record swarmRecord
+			if err := decodeBencode(v, &record); err == nil && record.lastActive() > cutoff {
+				return nil
+			}
+			expired = append(expired, append([]byte(nil), k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// lastActive returns when the record was last changed, for records written
+// before UpdatedAt existed the latest of its sighting and scrape times
+func (r *swarmRecord) lastActive() int64 {
+	last := r.UpdatedAt
+	if r.LastSeen > last {
+		last = r.LastSeen
+	}
+	if r.ScrapedAt > last {
+		last = r.ScrapedAt
+	}
+	return last
+}
+
+// persistSwarms moves the buffered swarm observations to the database on a
+// swarmFlushInterval ticker, so that a crash loses at most one interval of
+// them, and sweeps out stale records every swarmSweepInterval. It returns
+// when ctx is done; CrawlDHT flushes what is left.
+func persistSwarms(ctx context.Context) {
+	ticker := time.NewTicker(swarmFlushInterval)
+	defer ticker.Stop()
+	sweep := time.NewTicker(swarmSweepInterval)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			FlushSwarms()
+		case <-sweep.C:
+			SweepSwarms(swarmRecordTTL)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadSwarmRecord reads the swarm record for infohash, returning an empty
+// one if there is none or it cannot be decoded
+func loadSwarmRecord(tx *bolt.Tx, infohash string) swarmRecord {
+	var record swarmRecord
+	bucket := tx.Bucket([]byte(swarmBucketName))
+	if bucket == nil {
+		return record
+	}
+	if data := bucket.Get([]byte(infohash)); data != nil {
+		if err := decodeBencode(data, &record); err != nil {
+			return swarmRecord{}
+		}
+	}
+	return record
+}
+
+// GetSwarmStats returns the swarm statistics stored for infohash (hex).
+// Observations not flushed yet are not included.
+func GetSwarmStats(infohash string) (SwarmStats, error) {
+	var stats SwarmStats
+	if db == nil {
+		return stats, fmt.Errorf("database not initialised")
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		record := loadSwarmRecord(tx, infohash)
+		if record.FirstSeen != 0 {
+			stats.FirstSeen = time.Unix(record.FirstSeen, 0)
+		}
+		if record.LastSeen != 0 {
+			stats.LastSeen = time.Unix(record.LastSeen, 0)
+		}
+		stats.SeenCount = record.SeenCount
+		stats.PeerCount = record.PeerCount
+		stats.UniquePeers = len(record.Peers)
+		stats.Clients = record.Clients
+		stats.Seeders = record.Seeders
+		stats.Leechers = record.Leechers
+		if record.ScrapedAt != 0 {
+			stats.ScrapedAt = time.Unix(record.ScrapedAt, 0)
+		}
+
+		ips := make(map[string]bool)
+		for _, peer := range record.Peers {
+			if len(peer) == compactPeerLen || len(peer) == compactPeer6Len {
+				ips[peer[:len(peer)-2]] = true
+			}
+		}
+		stats.UniqueIPs = len(ips)
+		return nil
+	})
+	return stats, err
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// useTestDB points the db global at a fresh database for the test
+func useTestDB(t *testing.T) {
+	t.Helper()
+	testDB, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = testDB
+	t.Cleanup(func() {
+		db = saved
+		testDB.Close()
+	})
+}
+
+func storeSwarmRecord(t *testing.T, infohash string, record swarmRecord) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(swarmBucketName))
+		if err != nil {
+			return err
+		}
+		return putSwarmRecord(bucket, infohash, record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweepSwarms(t *testing.T) {
+	useTestDB(t)
+	now := time.Now()
+	old := now.Add(-2 * swarmRecordTTL).Unix()
+	storeSwarmRecord(t, "fresh", swarmRecord{LastSeen: now.Unix()})
+	storeSwarmRecord(t, "looked-up", swarmRecord{FirstSeen: old, LastSeen: old, UpdatedAt: now.Unix()})
+	storeSwarmRecord(t, "stale", swarmRecord{FirstSeen: old, LastSeen: old, UpdatedAt: old})
+	storeSwarmRecord(t, "legacy", swarmRecord{LastSeen: old})
+	storeSwarmRecord(t, "stored", swarmRecord{LastSeen: old, UpdatedAt: old})
+	if err := saveMetadataToBoltDB(db, "stored", []byte("d4:name1:xe")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SweepSwarms(swarmRecordTTL); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"fresh": true, "looked-up": true, "stale": false, "legacy": false, "stored": true}
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(swarmBucketName))
+		for infohash, kept := range want {
+			if got := bucket.Get([]byte(infohash)) != nil; got != kept {
+				t.Errorf("%s kept = %v, want %v", infohash, got, kept)
+			}
+		}
+		return nil
+	})
+}
+
+func TestSwarmAliases(t *testing.T) {
+	useTestDB(t)
+	defer func() { swarms.pending = make(map[string]*swarmUpdate) }()
+	v1 := strings.Repeat("1", 40)
+	v2 := strings.Repeat("2", 40)
+
+	// Seen by the truncated v2 infohash before the metadata was fetched
+	swarms.seen(v2)
+	swarms.addPeers(v2, "10.0.0.1:6881")
+	if err := FlushSwarms(); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMetadataToBoltDB(db, v1, []byte("d4:name1:xe"), v1, v2); err != nil {
+		t.Fatal(err)
+	}
+	// and by both infohashes after
+	swarms.seen(v1)
+	swarms.seen(v2)
+	swarms.addPeers(v2, "10.0.0.2:6881")
+	if err := FlushSwarms(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetSwarmStats(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SeenCount != 3 || stats.UniquePeers != 2 {
+		t.Errorf("stats = %d sightings, %d peers, want 3 and 2", stats.SeenCount, stats.UniquePeers)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(swarmBucketName)).Get([]byte(v2)) != nil {
+			t.Errorf("record kept under the alias")
+		}
+		return nil
+	})
+}
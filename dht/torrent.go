@@ -0,0 +1,280 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/jackpal/bencode-go"
+)
+
+// Bucket mapping the other infohash of a v2 or hybrid torrent to the one
+// its metadata is stored under
+const aliasBucketName = "Aliases"
+
+// Torrent is a decoded info dictionary
+type Torrent struct {
+	Infohash    string // Hex infohash the metadata is stored under
+	InfohashV1  string // Hex SHA-1 infohash, empty for v2-only torrents
+	InfohashV2  string // Hex SHA-256 infohash (BEP 52), empty for v1-only torrents
+	MetaVersion int    // 1, or 2 for v2 and hybrid torrents
+	Name        string
+	TotalSize   int64
+	PieceLength int64
+	PieceCount  int
+	Private     bool
+	Source      string // Optional "source" field set by some trackers
+	Files       []TorrentFile
+}
+
+// TorrentFile is one file of a torrent. Path is relative to the torrent's
+// root directory, with components joined by "/"; single-file torrents have
+// one file whose path is the torrent name.
+type TorrentFile struct {
+	Path   string
+	Length int64
+}
+
+// infoFile is a "files" entry of a v1 info dictionary
+type infoFile struct {
+	Length   int64    `bencode:"length"`
+	Path     []string `bencode:"path"`
+	PathUTF8 []string `bencode:"path.utf-8"`
+	Attr     string   `bencode:"attr"` // BEP 47; "p" marks padding files
+}
+
+// infoDict is the bencoded layout of an info dictionary. The BEP 52 "file
+// tree" is keyed by file names and is decoded separately.
+type infoDict struct {
+	MetaVersion int        `bencode:"meta version"`
+	Name        string     `bencode:"name"`
+	NameUTF8    string     `bencode:"name.utf-8"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Private     int        `bencode:"private"`
+	Source      string     `bencode:"source"`
+	Length      int64      `bencode:"length"`
+	Files       []infoFile `bencode:"files"`
+}
+
+// ParseTorrent decodes raw info dictionary bytes into a Torrent
+func ParseTorrent(infohash string, metadata []byte) (*Torrent, error) {
+	var info infoDict
+	if err := decodeBencode(metadata, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode info dictionary: %v", err)
+	}
+
+	t := &Torrent{
+		Infohash:    infohash,
+		MetaVersion: 1,
+		Name:        info.Name,
+		PieceLength: info.PieceLength,
+		PieceCount:  len(info.Pieces) / 20,
+		Private:     info.Private == 1,
+		Source:      info.Source,
+	}
+	if info.NameUTF8 != "" {
+		t.Name = info.NameUTF8
+	}
+	if t.Name == "" {
+		return nil, fmt.Errorf("info dictionary has no name")
+	}
+
+	// Hybrid torrents carry both layouts; only v1-only torrents lack the v2
+	// one, and only v2-only torrents lack pieces
+	hasV1 := info.MetaVersion != 2 || info.Pieces != ""
+	if hasV1 {
+		sum := sha1.Sum(metadata)
+		t.InfohashV1 = hex.EncodeToString(sum[:])
+	}
+	if info.MetaVersion == 2 {
+		sum := sha256.Sum256(metadata)
+		t.MetaVersion = 2
+		t.InfohashV2 = hex.EncodeToString(sum[:])
+		if err := t.decodeFileTree(metadata); err != nil {
+			return nil, err
+		}
+		if !hasV1 && t.PieceLength > 0 {
+			for _, file := range t.Files {
+				t.PieceCount += int((file.Length + t.PieceLength - 1) / t.PieceLength)
+			}
+		}
+		return t, nil
+	}
+
+	if len(info.Files) == 0 {
+		t.Files = []TorrentFile{{Path: t.Name, Length: info.Length}}
+		t.TotalSize = info.Length
+		return t, nil
+	}
+	for _, file := range info.Files {
+		if strings.Contains(file.Attr, "p") {
+			continue
+		}
+		path := file.Path
+		if len(file.PathUTF8) > 0 {
+			path = file.PathUTF8
+		}
+		t.Files = append(t.Files, TorrentFile{Path: strings.Join(path, "/"), Length: file.Length})
+		t.TotalSize += file.Length
+	}
+	return t, nil
+}
+
+// decodeFileTree fills in the files from the BEP 52 file tree, in which
+// directories are dictionaries keyed by name and a file is a dictionary
+// with an empty key holding its length
+func (t *Torrent) decodeFileTree(metadata []byte) error {
+	value, err := decodeBencodeValue(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to decode info dictionary: %v", err)
+	}
+	info, _ := value.(map[string]interface{})
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("v2 info dictionary has no file tree")
+	}
+
+	var walk func(dir map[string]interface{}, path []string)
+	walk = func(dir map[string]interface{}, path []string) {
+		names := make([]string, 0, len(dir))
+		for name := range dir {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entry, ok := dir[name].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if name == "" {
+				length, _ := entry["length"].(int64)
+				t.Files = append(t.Files, TorrentFile{Path: strings.Join(path, "/"), Length: length})
+				t.TotalSize += length
+				continue
+			}
+			walk(entry, append(path[:len(path):len(path)], name))
+		}
+	}
+	walk(tree, nil)
+	if len(t.Files) == 0 {
+		return fmt.Errorf("v2 file tree has no files")
+	}
+	return nil
+}
+
+// decodeBencodeValue decodes untrusted bencode into maps, slices, strings
+// and int64s
+func decodeBencodeValue(data []byte) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed bencode: %v", r)
+		}
+	}()
+	return bencode.Decode(bytes.NewReader(data))
+}
+
+// matchesInfohash reports whether metadata hashes to infohash (raw 20
+// bytes), either as a v1 SHA-1 infohash or as a v2 SHA-256 infohash
+// truncated to 20 bytes as it is in the DHT
+func matchesInfohash(metadata, infohash []byte) bool {
+	v1 := sha1.Sum(metadata)
+	if bytes.Equal(v1[:], infohash) {
+		return true
+	}
+	v2 := sha256.Sum256(metadata)
+	return bytes.Equal(v2[:len(infohash)], infohash)
+}
+
+// DHTInfohashes returns the hex infohashes the torrent is found by in the
+// DHT: the v1 infohash and the truncated v2 infohash
+func (t *Torrent) DHTInfohashes() []string {
+	var infohashes []string
+	if t.InfohashV1 != "" {
+		infohashes = append(infohashes, t.InfohashV1)
+	}
+	if t.InfohashV2 != "" {
+		infohashes = append(infohashes, t.InfohashV2[:40])
+	}
+	return infohashes
+}
+
+// Infohashes returns every hex infohash of the torrent: the ones it is found
+// by in the DHT and the full v2 infohash
+func (t *Torrent) Infohashes() []string {
+	infohashes := t.DHTInfohashes()
+	if t.InfohashV2 != "" {
+		infohashes = append(infohashes, t.InfohashV2)
+	}
+	return infohashes
+}
+
+// resolveInfohash returns the infohash the metadata of a torrent is stored
+// under, following the alias of a v2 or hybrid torrent's other infohash
+func resolveInfohash(tx *bolt.Tx, infohash string) string {
+	if bucket := tx.Bucket([]byte(aliasBucketName)); bucket != nil {
+		if stored := bucket.Get([]byte(infohash)); stored != nil {
+			return string(stored)
+		}
+	}
+	return infohash
+}
+
+// GetTorrent loads and decodes the stored metadata for infohash (hex), which
+// may be either infohash of a hybrid torrent
+func GetTorrent(infohash string) (*Torrent, error) {
+	var metadata []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Metadata"))
+		if bucket == nil {
+			return fmt.Errorf("bucket not found")
+		}
+		infohash = resolveInfohash(tx, infohash)
+		metadata = append(metadata, bucket.Get([]byte(infohash))...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, fmt.Errorf("no metadata found for infohash: %s", infohash)
+	}
+	return ParseTorrent(infohash, metadata)
+}
+
+// FilePaths returns the path of every file in the torrent
+func (t *Torrent) FilePaths() []string {
+	paths := make([]string, len(t.Files))
+	for i, file := range t.Files {
+		paths[i] = file.Path
+	}
+	return paths
+}
+
+// Size formats the total size for display
+func (t *Torrent) Size() string {
+	return formatSize(t.TotalSize)
+}
+
+// Size formats the file length for display
+func (f TorrentFile) Size() string {
+	return formatSize(f.Length)
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,160 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func encodeInfo(t *testing.T, info map[string]interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, info); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseTorrentV1(t *testing.T) {
+	single := encodeInfo(t, map[string]interface{}{
+		"name":         "ubuntu.iso",
+		"length":       int64(3 << 30),
+		"piece length": int64(1 << 20),
+		"pieces":       strings.Repeat("x", 40),
+		"private":      1,
+	})
+	torrent, err := ParseTorrent("aa", single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(single)
+	if torrent.InfohashV1 != hex.EncodeToString(sum[:]) || torrent.InfohashV2 != "" || torrent.MetaVersion != 1 {
+		t.Errorf("infohashes = %q, %q, version %d", torrent.InfohashV1, torrent.InfohashV2, torrent.MetaVersion)
+	}
+	if torrent.Name != "ubuntu.iso" || torrent.TotalSize != 3<<30 || torrent.PieceCount != 2 || !torrent.Private {
+		t.Errorf("single-file torrent = %+v", torrent)
+	}
+	if len(torrent.Files) != 1 || torrent.Files[0].Path != "ubuntu.iso" {
+		t.Errorf("files = %+v", torrent.Files)
+	}
+
+	multi := encodeInfo(t, map[string]interface{}{
+		"name":         "album",
+		"name.utf-8":   "álbum",
+		"piece length": int64(1 << 18),
+		"pieces":       strings.Repeat("x", 20),
+		"files": []interface{}{
+			map[string]interface{}{"length": int64(10), "path": []interface{}{"cd1", "01.flac"}},
+			map[string]interface{}{"length": int64(5), "path": []interface{}{".pad", "5"}, "attr": "p"},
+			map[string]interface{}{"length": int64(20), "path": []interface{}{"cover.jpg"}, "path.utf-8": []interface{}{"cövér.jpg"}},
+		},
+	})
+	torrent, err = ParseTorrent("bb", multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Name != "álbum" || torrent.TotalSize != 30 || len(torrent.Files) != 2 {
+		t.Fatalf("multi-file torrent = %+v", torrent)
+	}
+	if torrent.Files[0].Path != "cd1/01.flac" || torrent.Files[1].Path != "cövér.jpg" {
+		t.Errorf("files = %+v", torrent.Files)
+	}
+}
+
+func TestParseTorrentV2(t *testing.T) {
+	info := encodeInfo(t, map[string]interface{}{
+		"name":         "docs",
+		"meta version": 2,
+		"piece length": int64(16384),
+		"file tree": map[string]interface{}{
+			"b.txt": map[string]interface{}{"": map[string]interface{}{"length": int64(16385)}},
+			"dir": map[string]interface{}{
+				"a.txt": map[string]interface{}{"": map[string]interface{}{"length": int64(1)}},
+			},
+		},
+	})
+	torrent, err := ParseTorrent("cc", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(info)
+	if torrent.MetaVersion != 2 || torrent.InfohashV1 != "" || torrent.InfohashV2 != hex.EncodeToString(sum[:]) {
+		t.Errorf("infohashes = %q, %q, version %d", torrent.InfohashV1, torrent.InfohashV2, torrent.MetaVersion)
+	}
+	if torrent.TotalSize != 16386 || torrent.PieceCount != 3 || len(torrent.Files) != 2 {
+		t.Fatalf("v2 torrent = %+v", torrent)
+	}
+	if torrent.Files[0].Path != "b.txt" || torrent.Files[1].Path != "dir/a.txt" {
+		t.Errorf("files = %+v", torrent.Files)
+	}
+	if ih := torrent.DHTInfohashes(); len(ih) != 1 || ih[0] != torrent.InfohashV2[:40] {
+		t.Errorf("DHTInfohashes() = %v", ih)
+	}
+	if !matchesInfohash(info, sum[:20]) {
+		t.Error("matchesInfohash rejected the truncated v2 infohash")
+	}
+}
+
+func TestParseTorrentInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"not bencode":  []byte("d4:name"),
+		"no name":      encodeInfo(t, map[string]interface{}{"length": int64(1)}),
+		"no file tree": encodeInfo(t, map[string]interface{}{"name": "x", "meta version": 2}),
+		"empty tree":   encodeInfo(t, map[string]interface{}{"name": "x", "meta version": 2, "file tree": map[string]interface{}{}}),
+	}
+	for name, metadata := range tests {
+		if _, err := ParseTorrent("dd", metadata); err == nil {
+			t.Errorf("ParseTorrent accepted metadata with %s", name)
+		}
+	}
+}
+
+func TestMatchesInfohash(t *testing.T) {
+	metadata := []byte("d4:name1:xe")
+	v1 := sha1.Sum(metadata)
+	if !matchesInfohash(metadata, v1[:]) {
+		t.Error("matchesInfohash rejected the v1 infohash")
+	}
+	if matchesInfohash([]byte("d4:name1:ye"), v1[:]) {
+		t.Error("matchesInfohash accepted other metadata")
+	}
+}
+
+func TestStoredHybridTorrentAliases(t *testing.T) {
+	useTestDB(t)
+	info := encodeInfo(t, map[string]interface{}{
+		"name":         "hybrid.bin",
+		"meta version": 2,
+		"piece length": int64(16384),
+		"length":       int64(16384),
+		"pieces":       strings.Repeat("x", 20),
+		"file tree": map[string]interface{}{
+			"hybrid.bin": map[string]interface{}{"": map[string]interface{}{"length": int64(16384)}},
+		},
+	})
+	v1 := sha1.Sum(info)
+	v2 := sha256.Sum256(info)
+	infohash := hex.EncodeToString(v1[:])
+	if err := storeMetadata(infohash, info); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alias := range []string{infohash, hex.EncodeToString(v2[:20]), hex.EncodeToString(v2[:])} {
+		torrent, err := GetTorrent(alias)
+		if err != nil {
+			t.Errorf("GetTorrent(%s): %v", alias, err)
+			continue
+		}
+		if torrent.Infohash != infohash || torrent.Name != "hybrid.bin" {
+			t.Errorf("GetTorrent(%s) = %s %q", alias, torrent.Infohash, torrent.Name)
+		}
+		if !CheckInfohashExists(alias) {
+			t.Errorf("CheckInfohashExists(%s) = false", alias)
+		}
+	}
+}
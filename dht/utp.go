@@ -0,0 +1,547 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP configuration (BEP 29)
+const (
+	utpHeaderLength   = 20
+	utpVersion        = 1
+	utpMaxPayload     = 1200 // Keeps packets under common path MTUs
+	utpRecvWindow     = 1 << 20
+	utpMaxInflight    = 64 // Unacknowledged packets allowed in flight
+	utpMaxOutOfOrder  = 1024
+	utpInitialRTO     = time.Second
+	utpMinRTO         = 500 * time.Millisecond
+	utpMaxRTO         = 8 * time.Second
+	utpMaxRetransmits = 5
+	utpTickInterval   = 100 * time.Millisecond
+)
+
+// uTP packet types
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+// EnableUTP makes metadata connections try uTP alongside TCP
+var EnableUTP = true
+
+var errUTPReset = errors.New("utp: connection reset by peer")
+
+// utpHeader is the fixed header at the start of every uTP packet
+type utpHeader struct {
+	typ           byte
+	extension     byte
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+func (h utpHeader) marshal(payload []byte) []byte {
+	b := make([]byte, utpHeaderLength, utpHeaderLength+len(payload))
+	b[0] = h.typ<<4 | utpVersion
+	b[1] = h.extension
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	return append(b, payload...)
+}
+
+// parseUTPPacket splits a packet into its header and payload, skipping any
+// extensions such as selective ACKs
+func parseUTPPacket(packet []byte) (utpHeader, []byte, bool) {
+	var h utpHeader
+	if len(packet) < utpHeaderLength || packet[0]&0x0f != utpVersion || packet[0]>>4 > utpSyn {
+		return h, nil, false
+	}
+	h.typ = packet[0] >> 4
+	h.extension = packet[1]
+	h.connID = binary.BigEndian.Uint16(packet[2:])
+	h.timestamp = binary.BigEndian.Uint32(packet[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(packet[8:])
+	h.wndSize = binary.BigEndian.Uint32(packet[12:])
+	h.seqNr = binary.BigEndian.Uint16(packet[16:])
+	h.ackNr = binary.BigEndian.Uint16(packet[18:])
+
+	payload := packet[utpHeaderLength:]
+	for ext := h.extension; ext != 0; {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return h, nil, false
+		}
+		ext = payload[0]
+		payload = payload[2+int(payload[1]):]
+	}
+	return h, payload, true
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess compares sequence numbers allowing for wraparound
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// utpPacket is a sent packet awaiting acknowledgement
+type utpPacket struct {
+	typ           byte
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// utpConns holds the open uTP connections by remote address and the
+// connection ID they send to us with
+var utpConns = struct {
+	sync.Mutex
+	m map[string]*utpConn
+}{m: make(map[string]*utpConn)}
+
+func utpKey(addr *net.UDPAddr, connID uint16) string {
+	return fmt.Sprintf("%s/%d", addr.String(), connID)
+}
+
+// handleUTPPacket hands a packet received on the KRPC socket to the uTP
+// connection it belongs to. Packets for unknown connections, including
+// incoming SYNs, are dropped since we only make outgoing connections.
+func handleUTPPacket(from *net.UDPAddr, packet []byte) {
+	h, payload, ok := parseUTPPacket(packet)
+	if !ok {
+		return
+	}
+	utpConns.Lock()
+	c := utpConns.m[utpKey(from, h.connID)]
+	utpConns.Unlock()
+	if c != nil {
+		c.handle(h, payload)
+	}
+}
+
+// utpConn is an outgoing uTP connection carried over the KRPC UDP socket.
+// It implements net.Conn with a fixed send window and timeout-based
+// retransmission, which is plenty for metadata exchange.
+type utpConn struct {
+	udp    *net.UDPConn
+	raddr  *net.UDPAddr
+	recvID uint16 // Connection ID on packets we receive
+	sendID uint16 // Connection ID on packets we send
+	done   chan struct{}
+
+	mu            sync.Mutex
+	changed       chan struct{} // Closed and replaced whenever state changes
+	connected     bool
+	closed        bool
+	err           error
+	seqNr         uint16 // Next sequence number to send
+	ackNr         uint16 // Last sequence number received in order
+	inflight      []*utpPacket
+	readBuf       []byte
+	outOfOrder    map[uint16][]byte
+	gotFin        bool
+	finSeq        uint16
+	eof           bool
+	peerWnd       uint32
+	timestampDiff uint32
+	rtt, rttVar   time.Duration
+	rto           time.Duration
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// dialUTP opens a uTP connection to address over the KRPC socket
+func dialUTP(ctx context.Context, address string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	t, err := getTransport()
+	if err != nil {
+		return nil, err
+	}
+	udp, err := t.connFor(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &utpConn{
+		udp:        udp,
+		raddr:      raddr,
+		done:       make(chan struct{}),
+		changed:    make(chan struct{}),
+		seqNr:      1,
+		outOfOrder: make(map[uint16][]byte),
+		peerWnd:    utpRecvWindow,
+		rto:        utpInitialRTO,
+	}
+	utpConns.Lock()
+	for {
+		c.recvID = uint16(rand.Intn(1 << 16))
+		if _, ok := utpConns.m[utpKey(raddr, c.recvID)]; !ok {
+			break
+		}
+	}
+	c.sendID = c.recvID + 1
+	utpConns.m[utpKey(raddr, c.recvID)] = c
+	utpConns.Unlock()
+
+	c.mu.Lock()
+	c.sendPacket(utpSyn, nil)
+	c.mu.Unlock()
+	go c.run()
+
+	for {
+		c.mu.Lock()
+		connected, err, ch := c.connected, c.err, c.changed
+		c.mu.Unlock()
+		if connected {
+			return c, nil
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			c.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// notify wakes everything waiting on the connection. Callers hold c.mu.
+func (c *utpConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// fail ends the connection with err. Callers hold c.mu.
+func (c *utpConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.notify()
+}
+
+// header builds the header for an outgoing packet. Callers hold c.mu.
+func (c *utpConn) header(typ byte, seqNr uint16) utpHeader {
+	connID := c.sendID
+	if typ == utpSyn {
+		connID = c.recvID
+	}
+	window := utpRecvWindow - len(c.readBuf)
+	if window < 0 {
+		window = 0
+	}
+	return utpHeader{
+		typ:           typ,
+		connID:        connID,
+		timestamp:     utpNow(),
+		timestampDiff: c.timestampDiff,
+		wndSize:       uint32(window),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+	}
+}
+
+// sendPacket sends a SYN, DATA or FIN packet, which take a sequence number
+// and are retransmitted until acknowledged. Callers hold c.mu.
+func (c *utpConn) sendPacket(typ byte, payload []byte) {
+	p := &utpPacket{typ: typ, seqNr: c.seqNr, payload: payload, sentAt: time.Now(), transmissions: 1}
+	c.seqNr++
+	c.inflight = append(c.inflight, p)
+	c.udp.WriteToUDP(c.header(typ, p.seqNr).marshal(payload), c.raddr)
+}
+
+// sendState acknowledges what we have received. Callers hold c.mu.
+func (c *utpConn) sendState() {
+	c.udp.WriteToUDP(c.header(utpState, c.seqNr).marshal(nil), c.raddr)
+}
+
+// handle processes a packet from the peer
+func (c *utpConn) handle(h utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.err != nil {
+		return
+	}
+	if h.typ == utpReset {
+		c.fail(errUTPReset)
+		return
+	}
+	c.timestampDiff = utpNow() - h.timestamp
+	c.peerWnd = h.wndSize
+	if !c.connected {
+		// The SYN's acknowledgement carries the peer's first sequence number
+		c.connected = true
+		c.ackNr = h.seqNr - 1
+	}
+	c.acknowledge(h.ackNr)
+
+	switch h.typ {
+	case utpData:
+		c.receive(h.seqNr, payload)
+		c.sendState()
+	case utpFin:
+		c.gotFin = true
+		c.finSeq = h.seqNr
+		c.receive(h.seqNr, nil)
+		c.sendState()
+	}
+	c.notify()
+}
+
+// acknowledge drops the packets the peer has acknowledged, sampling the
+// round trip time from those sent only once. Callers hold c.mu.
+func (c *utpConn) acknowledge(ackNr uint16) {
+	now := time.Now()
+	kept := c.inflight[:0]
+	for _, p := range c.inflight {
+		if seqLess(ackNr, p.seqNr) {
+			kept = append(kept, p)
+			continue
+		}
+		if p.transmissions == 1 {
+			c.sampleRTT(now.Sub(p.sentAt))
+		}
+	}
+	c.inflight = kept
+}
+
+// sampleRTT updates the round trip estimate and timeout as in BEP 29.
+// Callers hold c.mu.
+func (c *utpConn) sampleRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < utpMinRTO {
+		c.rto = utpMinRTO
+	}
+}
+
+// receive queues data for reading in sequence order, buffering packets that
+// arrive early. Callers hold c.mu.
+func (c *utpConn) receive(seqNr uint16, payload []byte) {
+	if c.gotFin && seqLess(c.finSeq, seqNr) {
+		return
+	}
+	if seqNr == c.ackNr+1 {
+		c.readBuf = append(c.readBuf, payload...)
+		c.ackNr = seqNr
+		for {
+			next, ok := c.outOfOrder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.ackNr+1)
+			c.readBuf = append(c.readBuf, next...)
+			c.ackNr++
+		}
+	} else if seqLess(c.ackNr, seqNr) && len(c.outOfOrder) < utpMaxOutOfOrder {
+		c.outOfOrder[seqNr] = payload
+	}
+	if c.gotFin && !seqLess(c.ackNr, c.finSeq) {
+		c.eof = true
+	}
+}
+
+// run retransmits unacknowledged packets until the connection ends
+func (c *utpConn) run() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		now := time.Now()
+		timedOut := false
+		for _, p := range c.inflight {
+			if now.Sub(p.sentAt) < c.rto {
+				continue
+			}
+			if p.transmissions > utpMaxRetransmits {
+				c.fail(fmt.Errorf("utp: %v", os.ErrDeadlineExceeded))
+				break
+			}
+			p.sentAt = now
+			p.transmissions++
+			c.udp.WriteToUDP(c.header(p.typ, p.seqNr).marshal(p.payload), c.raddr)
+			timedOut = true
+		}
+		if timedOut && c.rto < utpMaxRTO {
+			c.rto *= 2
+		}
+		c.mu.Unlock()
+	}
+}
+
+// wait blocks until the connection changes or deadline passes
+func (c *utpConn) wait(ch <-chan struct{}, deadline time.Time) {
+	if deadline.IsZero() {
+		<-ch
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for {
+		switch {
+		case len(c.readBuf) > 0:
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			c.mu.Unlock()
+			return n, nil
+		case c.eof:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case c.closed:
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
+			c.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		ch, deadline := c.changed, c.readDeadline
+		c.mu.Unlock()
+		c.wait(ch, deadline)
+		c.mu.Lock()
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	written := 0
+	c.mu.Lock()
+	for len(b) > 0 {
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		case !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline):
+			c.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		window := int(c.peerWnd) / utpMaxPayload
+		if window > utpMaxInflight {
+			window = utpMaxInflight
+		}
+		if window < 1 {
+			window = 1
+		}
+		if len(c.inflight) < window {
+			n := len(b)
+			if n > utpMaxPayload {
+				n = utpMaxPayload
+			}
+			c.sendPacket(utpData, append([]byte(nil), b[:n]...))
+			written += n
+			b = b[n:]
+			continue
+		}
+
+		ch, deadline := c.changed, c.writeDeadline
+		c.mu.Unlock()
+		c.wait(ch, deadline)
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+	return written, nil
+}
+
+// Close sends a FIN without waiting for it to be acknowledged
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.connected && c.err == nil {
+		c.udp.WriteToUDP(c.header(utpFin, c.seqNr).marshal(nil), c.raddr)
+		c.seqNr++
+	}
+	c.closed = true
+	close(c.done)
+	c.notify()
+	c.mu.Unlock()
+
+	utpConns.Lock()
+	delete(utpConns.m, utpKey(c.raddr, c.recvID))
+	utpConns.Unlock()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr  { return c.udp.LocalAddr() }
+func (c *utpConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
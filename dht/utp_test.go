@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseUTPPacket(t *testing.T) {
+	h := utpHeader{
+		typ:           utpData,
+		connID:        0xbeef,
+		timestamp:     123456789,
+		timestampDiff: 42,
+		wndSize:       utpRecvWindow,
+		seqNr:         0xfffe,
+		ackNr:         7,
+	}
+	packet := h.marshal([]byte("payload"))
+	got, payload, ok := parseUTPPacket(packet)
+	if !ok || got != h || string(payload) != "payload" {
+		t.Errorf("parseUTPPacket(marshal(%+v)) = %+v, %q, %v", h, got, payload, ok)
+	}
+
+	// A selective ack extension followed by an unknown one is skipped
+	h.extension = 1
+	withExt := h.marshal(nil)
+	withExt = append(withExt, 99, 4, 0xff, 0, 0, 0)
+	withExt = append(withExt, 0, 2, 1, 2)
+	withExt = append(withExt, "data"...)
+	if _, payload, ok := parseUTPPacket(withExt); !ok || string(payload) != "data" {
+		t.Errorf("parseUTPPacket with extensions = %q, %v, want \"data\"", payload, ok)
+	}
+
+	bad := map[string][]byte{
+		"short":              packet[:utpHeaderLength-1],
+		"version":            append([]byte{utpData<<4 | 2}, packet[1:]...),
+		"type":               append([]byte{(utpSyn+1)<<4 | utpVersion}, packet[1:]...),
+		"truncated ext":      withExt[:utpHeaderLength+3],
+		"missing ext header": h.marshal(nil),
+	}
+	for name, packet := range bad {
+		if _, _, ok := parseUTPPacket(packet); ok {
+			t.Errorf("parseUTPPacket accepted a packet with a bad %s", name)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xffff, 0, true},
+		{0xfff0, 0x0010, true},
+		{0x0010, 0xfff0, false},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqLess(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestUTPHeaderMarshal(t *testing.T) {
+	packet := utpHeader{typ: utpSyn, connID: 1, seqNr: 1}.marshal(nil)
+	want := []byte{utpSyn<<4 | utpVersion, 0, 0, 1}
+	if len(packet) != utpHeaderLength || !bytes.Equal(packet[:4], want) {
+		t.Errorf("marshal() = %x, want a %d byte header starting %x", packet, utpHeaderLength, want)
+	}
+}
@@ -33,6 +33,9 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 	if err!=nil{
 		log.Println(err)
 	}
+	if r.FormValue("sort") == "popularity" {
+		dht.SortByPopularity(data)
+	}
 	t, err := template.ParseFiles("template/search.html")
 	if err != nil {
 		http.Error(w, "Error loading template", http.StatusInternalServerError)